@@ -0,0 +1,197 @@
+package castle
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var auditDroppedCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "iam",
+	Subsystem: "castle",
+	Name:      "audit_dropped_total",
+	Help:      "Number of audit records dropped because the buffer was full",
+})
+
+// DefaultAuditBufferSize is the number of records an Auditor buffers before dropping new ones.
+const DefaultAuditBufferSize = 1024
+
+// AuditRecord describes a single call to Castle and its decision.
+type AuditRecord struct {
+	Time        time.Time   `json:"time"`
+	Endpoint    Endpoint    `json:"endpoint"`
+	EventType   EventType   `json:"event_type"`
+	EventStatus EventStatus `json:"event_status"`
+	EventName   string      `json:"event_name,omitempty"`
+	UserID      string      `json:"user_id,omitempty"`
+	// EmailHash is the hex encoded HMAC-SHA256 of the normalised email with the WithAuditHashKey key.
+	// Emails are not recorded without a key, a plain hash would be reversed by a dictionary lookup.
+	EmailHash        string            `json:"email_hash,omitempty"`
+	IP               string            `json:"ip,omitempty"`
+	Action           RecommendedAction `json:"action,omitempty"`
+	Risk             float32           `json:"risk"`
+	PolicyID         string            `json:"policy_id,omitempty"`
+	PolicyRevisionID string            `json:"policy_revision_id,omitempty"`
+	LatencyMS        float64           `json:"latency_ms"`
+	// Fallback is set when Castle was not called, see Decision.Skipped.
+	Fallback bool `json:"fallback"`
+	// Failed is set when the decision is the failure action, see Decision.Failed.
+	Failed bool   `json:"failed"`
+	Error  string `json:"error,omitempty"`
+}
+
+// AuditSink stores audit records, e.g. in a file or a message queue.
+// Write is only ever called from a single goroutine.
+type AuditSink interface {
+	Write(record *AuditRecord) error
+}
+
+// Auditor records every call made by a client to a sink, see Interceptor.
+// Records are written in the background: when the sink falls behind and the buffer is full, new records are
+// dropped rather than blocking the call.
+type Auditor struct {
+	sink         AuditSink
+	hashKey      []byte
+	errorHandler func(err error)
+
+	mu      sync.RWMutex
+	closed  bool
+	records chan *AuditRecord
+	done    chan struct{}
+	dropped atomic.Uint64
+}
+
+type AuditorOpt func(*Auditor)
+
+// WithAuditBufferSize sets the number of buffered records, it defaults to DefaultAuditBufferSize.
+func WithAuditBufferSize(n int) AuditorOpt {
+	return func(a *Auditor) {
+		a.records = make(chan *AuditRecord, n)
+	}
+}
+
+// WithAuditHashKey records emails hashed with HMAC-SHA256 and the given key, they are not recorded otherwise.
+func WithAuditHashKey(key []byte) AuditorOpt {
+	return func(a *Auditor) {
+		a.hashKey = key
+	}
+}
+
+// WithAuditErrorHandler sets the function called with the errors returned by the sink.
+func WithAuditErrorHandler(fn func(err error)) AuditorOpt {
+	return func(a *Auditor) {
+		a.errorHandler = fn
+	}
+}
+
+// NewAuditor starts writing records to sink in the background, until Close is called.
+func NewAuditor(sink AuditSink, opts ...AuditorOpt) *Auditor {
+	a := &Auditor{
+		sink:    sink,
+		records: make(chan *AuditRecord, DefaultAuditBufferSize),
+		done:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	go a.run()
+	return a
+}
+
+func (a *Auditor) run() {
+	defer close(a.done)
+	for r := range a.records {
+		if err := a.sink.Write(r); err != nil && a.errorHandler != nil {
+			a.errorHandler(err)
+		}
+	}
+}
+
+// Interceptor returns the interceptor recording calls, pass it to WithInterceptors.
+// Put it first to also record the calls short-circuited by other interceptors.
+func (a *Auditor) Interceptor() Interceptor {
+	return func(ctx context.Context, endpoint Endpoint, req *Request, next Invoker) (*Decision, error) {
+		start := time.Now()
+		d, err := next(ctx, endpoint, req)
+
+		r := &AuditRecord{
+			Time:        start,
+			Endpoint:    endpoint,
+			EventType:   req.Event.EventType,
+			EventStatus: req.Event.EventStatus,
+			EventName:   req.Event.Name,
+			UserID:      req.User.ID,
+			EmailHash:   a.hashEmail(req.User.Email),
+			LatencyMS:   float64(time.Since(start)) / float64(time.Millisecond),
+		}
+		if req.Context != nil {
+			r.IP = req.Context.IP
+		}
+		if d != nil {
+			r.Action = d.Action
+			r.Risk = d.Risk
+			r.PolicyID = d.PolicyID
+			r.PolicyRevisionID = d.PolicyRevisionID
+			r.Fallback = d.Skipped
+			r.Failed = d.Failed
+		}
+		if err != nil {
+			r.Error = err.Error()
+		}
+		a.enqueue(r)
+
+		return d, err
+	}
+}
+
+func (a *Auditor) enqueue(r *AuditRecord) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return
+	}
+
+	select {
+	case a.records <- r:
+	default:
+		a.dropped.Add(1)
+		auditDroppedCounter.Inc()
+	}
+}
+
+func (a *Auditor) hashEmail(email string) string {
+	if email == "" || len(a.hashKey) == 0 {
+		return ""
+	}
+	return hmacHex(a.hashKey, normalizeEmail(email))
+}
+
+// Dropped returns the number of records dropped because the buffer was full.
+func (a *Auditor) Dropped() uint64 {
+	return a.dropped.Load()
+}
+
+// Close stops accepting records, waits for the buffered ones to be written and closes the sink
+// if it is an io.Closer. Calls recorded afterwards are ignored.
+func (a *Auditor) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	close(a.records)
+	a.mu.Unlock()
+
+	<-a.done
+	if c, ok := a.sink.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
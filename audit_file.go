@@ -0,0 +1,188 @@
+package castle
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultAuditFileMaxSize is the size a FileSink file is rotated at.
+	DefaultAuditFileMaxSize = 100 << 20
+	// DefaultAuditFileMaxBackups is the number of rotated files a FileSink keeps.
+	DefaultAuditFileMaxBackups = 10
+
+	// backupTimeFormat is the suffix of rotated files, it sorts by age.
+	backupTimeFormat = "20060102T150405.000000000"
+)
+
+// FileSink writes audit records to a file as JSON lines. Once the file reaches its maximum size, it is
+// renamed with a timestamp suffix and a new one is started; the oldest rotated files are removed.
+type FileSink struct {
+	path         string
+	maxSize      int64
+	maxBackups   int
+	cleanupError func(err error)
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	closed bool
+}
+
+type FileSinkOpt func(*FileSink)
+
+// WithMaxFileSize sets the size in bytes a file is rotated at, it defaults to DefaultAuditFileMaxSize.
+func WithMaxFileSize(n int64) FileSinkOpt {
+	return func(s *FileSink) {
+		s.maxSize = n
+	}
+}
+
+// WithMaxBackups sets the number of rotated files kept, it defaults to DefaultAuditFileMaxBackups.
+// Zero keeps all of them.
+func WithMaxBackups(n int) FileSinkOpt {
+	return func(s *FileSink) {
+		s.maxBackups = n
+	}
+}
+
+// WithCleanupErrorHandler sets the function called when rotated files beyond the maximum can't be removed.
+// The record being written when it happens is not affected, so the error is not returned by Write.
+func WithCleanupErrorHandler(fn func(err error)) FileSinkOpt {
+	return func(s *FileSink) {
+		s.cleanupError = fn
+	}
+}
+
+// NewFileSink opens, or creates, the file at path for appending.
+func NewFileSink(path string, opts ...FileSinkOpt) (*FileSink, error) {
+	s := &FileSink{
+		path:       path,
+		maxSize:    DefaultAuditFileMaxSize,
+		maxBackups: DefaultAuditFileMaxBackups,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to open audit file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close() // nolint: errcheck,gosec
+		return fmt.Errorf("unable to open audit file: %w", err)
+	}
+	s.file = f
+	s.size = info.Size()
+	return nil
+}
+
+// Write appends the record as a single line, rotating the file first if it would grow past its maximum size.
+func (s *FileSink) Write(record *AuditRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("unable to encode audit record: %w", err)
+	}
+	b = append(b, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("audit file is closed")
+	}
+	// a failed rotation leaves no file open, try again
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	rotated := false
+	if s.size > 0 && s.size+int64(len(b)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		rotated = true
+	}
+	n, err := s.file.Write(b)
+	s.size += int64(n)
+	if rotated {
+		if err := s.removeBackups(); err != nil && s.cleanupError != nil {
+			s.cleanupError(fmt.Errorf("unable to remove old audit files: %w", err))
+		}
+	}
+	return err
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("unable to rotate audit file: %w", err)
+	}
+	s.file = nil
+
+	rotated := s.path + "." + time.Now().UTC().Format(backupTimeFormat)
+	if err := os.Rename(s.path, rotated); err != nil {
+		return fmt.Errorf("unable to rotate audit file: %w", err)
+	}
+	return s.open()
+}
+
+// removeBackups removes the oldest rotated files beyond maxBackups, the timestamp suffixes sort by age.
+// Only files named after the path and a timestamp suffix are considered, other files sharing the prefix are kept.
+func (s *FileSink) removeBackups() error {
+	if s.maxBackups <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(filepath.Dir(s.path))
+	if err != nil {
+		return err
+	}
+	prefix := filepath.Base(s.path) + "."
+	var backups []string
+	for _, entry := range entries {
+		suffix, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(backupTimeFormat, suffix); err != nil {
+			continue
+		}
+		backups = append(backups, filepath.Join(filepath.Dir(s.path), entry.Name()))
+	}
+	if len(backups) <= s.maxBackups {
+		return nil
+	}
+	slices.Sort(backups)
+	var errs []error
+	for _, b := range backups[:len(backups)-s.maxBackups] {
+		errs = append(errs, os.Remove(b))
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes the current file.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -0,0 +1,102 @@
+package castle_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/utilitywarehouse/castle-go"
+)
+
+func readAuditFile(t *testing.T, path string) []castle.AuditRecord {
+	t.Helper()
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var records []castle.AuditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r castle.AuditRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &r))
+		records = append(records, r)
+	}
+	require.NoError(t, scanner.Err())
+	return records
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	record := &castle.AuditRecord{
+		Time:      time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC),
+		Endpoint:  castle.EndpointFilter,
+		EventType: castle.EventTypeLogin,
+		UserID:    "user-id",
+		Action:    castle.RecommendedActionDeny,
+		PolicyID:  "policy-id",
+	}
+
+	sink, err := castle.NewFileSink(path)
+	require.NoError(t, err)
+	require.NoError(t, sink.Write(record))
+	require.NoError(t, sink.Close())
+
+	// appends to the existing file
+	sink, err = castle.NewFileSink(path)
+	require.NoError(t, err)
+	require.NoError(t, sink.Write(record))
+	require.NoError(t, sink.Close())
+	assert.Error(t, sink.Write(record))
+
+	assert.Equal(t, []castle.AuditRecord{*record, *record}, readAuditFile(t, path))
+}
+
+func TestFileSink_Rotation(t *testing.T) {
+	dir := t.TempDir()
+	// glob metacharacters in the path don't change which files are backups
+	path := filepath.Join(dir, "audit[*].jsonl")
+	// files sharing the prefix are never removed
+	unrelated := []string{path + ".bak", path + ".20240101", filepath.Join(dir, "audit[*].jsonl-old")}
+	for _, f := range unrelated {
+		require.NoError(t, os.WriteFile(f, nil, 0o600))
+	}
+	record := &castle.AuditRecord{UserID: "user-id"}
+
+	line, err := json.Marshal(record)
+	require.NoError(t, err)
+
+	// two records per file
+	sink, err := castle.NewFileSink(path, castle.WithMaxFileSize(int64(2*(len(line)+1))), castle.WithMaxBackups(2))
+	require.NoError(t, err)
+	for range 7 {
+		require.NoError(t, sink.Write(record))
+	}
+	require.NoError(t, sink.Close())
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var backups []string
+	for _, e := range entries {
+		name := filepath.Join(dir, e.Name())
+		if strings.HasPrefix(name, path+".") && !slices.Contains(unrelated, name) {
+			backups = append(backups, name)
+		}
+	}
+	assert.Len(t, backups, 2)
+	for _, b := range backups {
+		assert.Len(t, readAuditFile(t, b), 2)
+	}
+	assert.Len(t, readAuditFile(t, path), 1)
+	for _, f := range unrelated {
+		assert.FileExists(t, f)
+	}
+}
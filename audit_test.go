@@ -0,0 +1,134 @@
+package castle_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/utilitywarehouse/castle-go"
+)
+
+type memorySink struct {
+	mu      sync.Mutex
+	records []*castle.AuditRecord
+	block   chan struct{}
+	closed  bool
+}
+
+func (s *memorySink) Write(r *castle.AuditRecord) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, r)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestAuditor(t *testing.T) {
+	sink := &memorySink{}
+	auditor := castle.NewAuditor(sink, castle.WithAuditHashKey([]byte("key")))
+
+	got := map[string]any{}
+	cstl := newCapturingClient(t, got, castle.WithInterceptors(auditor.Interceptor()))
+
+	req := configureRequest(configureHTTPRequest())
+	req.User.Email = " User@Test.com"
+	_, err := cstl.Risk(context.Background(), req)
+	require.NoError(t, err)
+
+	require.NoError(t, auditor.Close())
+	assert.True(t, sink.closed)
+	require.Len(t, sink.records, 1)
+
+	r := sink.records[0]
+	assert.Equal(t, castle.EndpointRisk, r.Endpoint)
+	assert.Equal(t, castle.EventTypeLogin, r.EventType)
+	assert.Equal(t, castle.EventStatusSucceeded, r.EventStatus)
+	assert.Equal(t, "user-id", r.UserID)
+	// hmac-sha256("key", "user@test.com"), the email is normalised first
+	assert.Equal(t, "9b822f11869d4dbed1cac843c6158ee95b9fd423028d9d6fbf6f9a0693120944", r.EmailHash)
+	assert.Equal(t, "6.6.6.6", r.IP)
+	assert.Equal(t, castle.RecommendedActionAllow, r.Action)
+	assert.False(t, r.Fallback)
+	assert.False(t, r.Failed)
+	assert.Empty(t, r.Error)
+
+	// calls after Close are not recorded
+	_, err = cstl.Risk(context.Background(), req)
+	require.NoError(t, err)
+	assert.Len(t, sink.records, 1)
+}
+
+func TestAuditor_Failed(t *testing.T) {
+	sink := &memorySink{}
+	auditor := castle.NewAuditor(sink)
+	cstl := newCapturingClient(t, map[string]any{}, castle.WithInterceptors(
+		auditor.Interceptor(),
+		func(context.Context, castle.Endpoint, *castle.Request, castle.Invoker) (*castle.Decision, error) {
+			return &castle.Decision{Action: castle.RecommendedActionDeny, Failed: true}, errors.New("failed")
+		},
+	))
+
+	_, err := cstl.Filter(context.Background(), configureRequest(configureHTTPRequest()))
+	require.EqualError(t, err, "failed")
+	require.NoError(t, auditor.Close())
+
+	require.Len(t, sink.records, 1)
+	assert.Equal(t, castle.RecommendedActionDeny, sink.records[0].Action)
+	assert.True(t, sink.records[0].Failed)
+	assert.False(t, sink.records[0].Fallback)
+	assert.Equal(t, "failed", sink.records[0].Error)
+}
+
+func TestAuditor_EmailHash(t *testing.T) {
+	hashOf := func(opts ...castle.AuditorOpt) string {
+		sink := &memorySink{}
+		auditor := castle.NewAuditor(sink, opts...)
+		cstl := newCapturingClient(t, map[string]any{}, castle.WithInterceptors(auditor.Interceptor()))
+
+		req := configureRequest(configureHTTPRequest())
+		req.User.Email = "user@test.com"
+		_, err := cstl.Filter(context.Background(), req)
+		require.NoError(t, err)
+		require.NoError(t, auditor.Close())
+		return sink.records[0].EmailHash
+	}
+
+	// a plain hash would be reversed by a dictionary lookup
+	assert.Empty(t, hashOf())
+	assert.Equal(t, "9b822f11869d4dbed1cac843c6158ee95b9fd423028d9d6fbf6f9a0693120944", hashOf(castle.WithAuditHashKey([]byte("key"))))
+	assert.NotEqual(t, hashOf(castle.WithAuditHashKey([]byte("key"))), hashOf(castle.WithAuditHashKey([]byte("other-key"))))
+}
+
+func TestAuditor_NonBlocking(t *testing.T) {
+	sink := &memorySink{block: make(chan struct{})}
+	auditor := castle.NewAuditor(sink, castle.WithAuditBufferSize(1))
+
+	cstl := newCapturingClient(t, map[string]any{}, castle.WithInterceptors(
+		auditor.Interceptor(),
+		func(context.Context, castle.Endpoint, *castle.Request, castle.Invoker) (*castle.Decision, error) {
+			return nil, errors.New("failed")
+		},
+	))
+
+	// the first record is held by the blocked sink, the second fills the buffer, the rest are dropped
+	for range 5 {
+		_, err := cstl.Filter(context.Background(), configureRequest(configureHTTPRequest()))
+		require.EqualError(t, err, "failed")
+	}
+	assert.GreaterOrEqual(t, auditor.Dropped(), uint64(3))
+
+	close(sink.block)
+	require.NoError(t, auditor.Close())
+	assert.Equal(t, "failed", sink.records[0].Error)
+}
@@ -0,0 +1,126 @@
+package castle
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const challengeVersion = "c1"
+
+// ErrNotChallenge is returned when starting a challenge session from a decision other than a challenge.
+var ErrNotChallenge = errors.New("castle decision is not a challenge")
+
+// ChallengeSession ties the $challenge events following a challenge decision to the request it was made for.
+// Castle links the events to the device of the original request through its request token.
+type ChallengeSession struct {
+	Context   *Context
+	User      User
+	StartedAt time.Time
+}
+
+// NewChallengeSession starts a challenge session from the request sent to Risk or Filter and its decision,
+// which must be a challenge.
+func NewChallengeSession(req *Request, d *Decision) (*ChallengeSession, error) {
+	if req == nil || req.Context == nil {
+		return nil, errors.New("request and request.Context cannot be nil")
+	}
+	if d == nil || d.Action != RecommendedActionChallenge {
+		return nil, ErrNotChallenge
+	}
+	return &ChallengeSession{
+		Context:   req.Context,
+		User:      req.User,
+		StartedAt: time.Now(),
+	}, nil
+}
+
+// Requested sends a $challenge $requested event, once the challenge has been presented to the user.
+// am is the method of the challenge, e.g. $authenticator or $phone, not the one of the original request.
+func (s *ChallengeSession) Requested(ctx context.Context, c Client, am *AuthenticationMethod) (RecommendedAction, error) {
+	return s.send(ctx, c, EventStatusRequested, am)
+}
+
+// Succeeded sends a $challenge $succeeded event for the challenge method am.
+func (s *ChallengeSession) Succeeded(ctx context.Context, c Client, am *AuthenticationMethod) (RecommendedAction, error) {
+	return s.send(ctx, c, EventStatusSucceeded, am)
+}
+
+// Failed sends a $challenge $failed event for the challenge method am.
+func (s *ChallengeSession) Failed(ctx context.Context, c Client, am *AuthenticationMethod) (RecommendedAction, error) {
+	return s.send(ctx, c, EventStatusFailed, am)
+}
+
+// send uses the Castle context found in ctx when there is one, e.g. the one of the request to the MFA service,
+// and the context of the original request otherwise.
+func (s *ChallengeSession) send(ctx context.Context, c Client, status EventStatus, am *AuthenticationMethod) (RecommendedAction, error) {
+	castleCtx := FromCtx(ctx)
+	if castleCtx == nil {
+		castleCtx = s.Context
+	}
+	return c.Risk(ctx, &Request{
+		Context: castleCtx,
+		Event: Event{
+			EventType:            EventTypeChallenge,
+			EventStatus:          status,
+			AuthenticationMethod: am,
+		},
+		User: s.User,
+	})
+}
+
+type encodedChallenge struct {
+	Context     propagatedContext `json:"c"`
+	User        User              `json:"u"`
+	TypedTraits Properties        `json:"tt,omitempty"`
+	// StartedAt is in unix milliseconds
+	StartedAt int64 `json:"at"`
+}
+
+// Encode encodes the session into an opaque string, e.g. to carry it through a redirect to an MFA service.
+// The session holds user data, so the propagator should have a signing key unless the string stays server side.
+func (s *ChallengeSession) Encode(p *Propagator) (string, error) {
+	if s.Context == nil {
+		return "", errors.New("castle context cannot be nil")
+	}
+	return p.seal(challengeVersion, "challenge session", encodedChallenge{
+		Context: propagatedContext{
+			IP:           s.Context.IP,
+			Headers:      s.Context.Headers,
+			RequestToken: s.Context.RequestToken,
+		},
+		User:        s.User,
+		TypedTraits: s.User.TypedTraits,
+		StartedAt:   s.StartedAt.UnixMilli(),
+	})
+}
+
+// DecodeChallengeSession decodes a session encoded by ChallengeSession.Encode.
+// Sessions started longer ago than the propagator max age are rejected with ErrContextExpired.
+func DecodeChallengeSession(p *Propagator, s string) (*ChallengeSession, error) {
+	ec := &encodedChallenge{}
+	if err := p.open(challengeVersion, "challenge session", s, ec); err != nil {
+		return nil, err
+	}
+
+	startedAt := time.UnixMilli(ec.StartedAt)
+	if p.expired(startedAt) {
+		return nil, ErrContextExpired
+	}
+
+	headers := ec.Context.Headers
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	user := ec.User
+	user.TypedTraits = ec.TypedTraits
+	return &ChallengeSession{
+		Context: &Context{
+			IP:           ec.Context.IP,
+			Headers:      headers,
+			RequestToken: ec.Context.RequestToken,
+		},
+		User:      user,
+		StartedAt: startedAt,
+	}, nil
+}
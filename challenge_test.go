@@ -0,0 +1,99 @@
+package castle_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/utilitywarehouse/castle-go"
+)
+
+func newChallengeSession(t *testing.T) *castle.ChallengeSession {
+	t.Helper()
+
+	req := configureRequest(configureHTTPRequest())
+	req.User.TypedTraits = castle.Properties{}.Set("verified", true)
+	req.Event.AuthenticationMethod = &castle.AuthenticationMethod{Type: castle.AuthenticationMethodPassword}
+
+	s, err := castle.NewChallengeSession(req, &castle.Decision{
+		Action:      castle.RecommendedActionChallenge,
+		DeviceToken: "device-token",
+	})
+	require.NoError(t, err)
+	return s
+}
+
+func TestNewChallengeSession(t *testing.T) {
+	s := newChallengeSession(t)
+	assert.Equal(t, "user-id", s.User.ID)
+	assert.Equal(t, "request-token", s.Context.RequestToken)
+
+	_, err := castle.NewChallengeSession(configureRequest(configureHTTPRequest()), &castle.Decision{Action: castle.RecommendedActionAllow})
+	assert.ErrorIs(t, err, castle.ErrNotChallenge)
+}
+
+func TestChallengeSession_Events(t *testing.T) {
+	got := map[string]any{}
+	cstl := newCapturingClient(t, got)
+	s := newChallengeSession(t)
+
+	am := &castle.AuthenticationMethod{Type: castle.AuthenticationMethodAuthenticator}
+	tests := map[string]struct {
+		send     func(ctx context.Context, c castle.Client, am *castle.AuthenticationMethod) (castle.RecommendedAction, error)
+		expected string
+	}{
+		"requested": {send: s.Requested, expected: "$requested"},
+		"succeeded": {send: s.Succeeded, expected: "$succeeded"},
+		"failed":    {send: s.Failed, expected: "$failed"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := test.send(context.Background(), cstl, am)
+			require.NoError(t, err)
+
+			assert.Equal(t, "$challenge", got["type"])
+			assert.Equal(t, test.expected, got["status"])
+			assert.Equal(t, "request-token", got["request_token"])
+			assert.Equal(t, map[string]any{"type": "$authenticator"}, got["authentication_method"])
+			assert.Equal(t, map[string]any{
+				"id":     "user-id",
+				"email":  "user@test.com",
+				"traits": map[string]any{"trait1": "traitValue1", "verified": true},
+			}, got["user"])
+		})
+	}
+
+	t.Run("context of the current request", func(t *testing.T) {
+		ctx := castle.ToCtx(context.Background(), &castle.Context{IP: "8.8.4.4", RequestToken: "mfa-token"})
+
+		_, err := s.Succeeded(ctx, cstl, am)
+		require.NoError(t, err)
+		assert.Equal(t, "mfa-token", got["request_token"])
+	})
+}
+
+func TestChallengeSession_Encode(t *testing.T) {
+	s := newChallengeSession(t)
+	p := castle.NewPropagator(castle.WithSigningKey([]byte("key")), castle.WithMaxAge(time.Minute))
+
+	encoded, err := s.Encode(p)
+	require.NoError(t, err)
+
+	got, err := castle.DecodeChallengeSession(p, encoded)
+	require.NoError(t, err)
+	assert.True(t, s.StartedAt.Truncate(time.Millisecond).Equal(got.StartedAt))
+	got.StartedAt = s.StartedAt
+	assert.Equal(t, s, got)
+
+	// a propagated context is not a challenge session
+	propagated, err := p.Encode(s.Context)
+	require.NoError(t, err)
+	_, err = castle.DecodeChallengeSession(p, propagated)
+	assert.ErrorContains(t, err, "malformed challenge session")
+
+	_, err = castle.DecodeChallengeSession(castle.NewPropagator(castle.WithSigningKey([]byte("other-key"))), encoded)
+	assert.ErrorIs(t, err, castle.ErrInvalidSignature)
+}
@@ -1,7 +1,7 @@
 package castle
 
 import (
-	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
@@ -19,7 +19,7 @@ var castleReqsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 	Subsystem: "castle",
 	Name:      "requests_total",
 	Help:      "Number of requests made to castle",
-}, []string{"endpoint", "status"})
+}, []string{"endpoint", "status", "tenant"})
 
 var (
 	FilterEndpoint = "https://api.castle.io/v1/filter"
@@ -37,142 +37,350 @@ func (e *APIError) Error() string {
 
 // Castle encapsulates http client
 type Castle struct {
-	client    *http.Client
-	apiSecret string
+	client *http.Client
+	secret SecretProvider
+	tenant string
+
+	filterEndpoint string
+	riskEndpoint   string
 
 	metricsEnabled bool
+
+	latency       *latencyTracker
+	fallback      RecommendedAction
+	failureAction RecommendedAction
+	interceptor   Interceptor
+	privacy       *PrivacyPolicy
+	normalization *Normalization
+	sampling      SamplingConfig
+
+	retries      int
+	retryBackoff time.Duration
 }
 
-// New creates a new castle client with default http client
+// New creates a new castle client with its own http client, see NewHTTPClient.
+// The secret is ignored when WithSecretProvider is passed.
 func New(secret string, opts ...Opt) (*Castle, error) {
-	return NewWithHTTPClient(secret, http.DefaultClient, opts...)
+	return NewWithHTTPClient(secret, NewHTTPClient(newOptions(opts).timeout), opts...)
 }
 
 // NewWithHTTPClient same as New but allows passing of http.Client with custom config
 func NewWithHTTPClient(secret string, client *http.Client, opts ...Opt) (*Castle, error) {
-	os := &options{
-		metricsEnabled: true,
+	os := newOptions(opts)
+	if os.secretProvider == nil {
+		os.secretProvider = StaticSecret(secret)
 	}
-	for _, opt := range opts {
-		opt(os)
+	if os.privacy != nil {
+		if err := os.privacy.validate(); err != nil {
+			return nil, err
+		}
 	}
-	return &Castle{
+	if os.normalization != nil {
+		if err := os.normalization.validate(os.privacy); err != nil {
+			return nil, err
+		}
+	}
+	c := &Castle{
 		client:         client,
-		apiSecret:      secret,
+		secret:         os.secretProvider,
+		tenant:         os.tenant,
+		filterEndpoint: os.filterEndpoint,
+		riskEndpoint:   os.riskEndpoint,
 		metricsEnabled: os.metricsEnabled,
-	}, nil
+		fallback:       os.fallback,
+		failureAction:  os.failureAction,
+		interceptor:    ChainInterceptors(os.interceptors...),
+		privacy:        os.privacy,
+		normalization:  os.normalization,
+		sampling:       os.sampling,
+		retries:        os.retries,
+		retryBackoff:   os.retryBackoff,
+	}
+	if os.latencyBudget > 0 {
+		c.latency = newLatencyTracker(os.latencyBudget)
+	}
+	if os.warmConns > 0 {
+		go c.Warm(context.Background(), os.warmConns) // nolint: errcheck
+	}
+	return c, nil
+}
+
+// Decision is the full outcome of a Filter or Risk call.
+type Decision struct {
+	Action           RecommendedAction
+	Risk             float32
+	PolicyName       string
+	PolicyID         string
+	PolicyRevisionID string
+	// DeviceToken identifies the device the request was made from.
+	DeviceToken string
+	// Skipped is set when Castle was not called and the decision is the fallback, see WithFallback.
+	Skipped bool
+	// Failed is set when the call failed and the decision is the failure action, see WithFailureAction.
+	// The error is returned along with it.
+	Failed bool
 }
 
 // Filter sends a filter request to castle.io
 // see https://reference.castle.io/#operation/filter for details
+// Failed calls return the action set with WithFailureAction along with the error.
 func (c *Castle) Filter(ctx context.Context, req *Request) (RecommendedAction, error) {
+	return actionOf(c.FilterDecision(ctx, req))
+}
+
+// FilterDecision is the same as Filter but returns the full decision.
+func (c *Castle) FilterDecision(ctx context.Context, req *Request) (*Decision, error) {
 	if req == nil {
-		return RecommendedActionNone, errors.New("request cannot be nil")
+		return nil, errors.New("request cannot be nil")
 	}
+	return c.invoke(ctx, EndpointFilter, req)
+}
+
+func (c *Castle) filter(ctx context.Context, req *Request) (*Decision, error) {
 	if req.Context == nil {
-		return RecommendedActionNone, errors.New("request.Context cannot be nil")
-	}
-	params := Params{
-		Email:    req.User.Email,
-		Username: req.User.ID,
+		return nil, errors.New("request.Context cannot be nil")
 	}
+	params, properties := newCastleAPIParams(req.User, req.IdentityFields, mergeProperties(req.Properties, req.TypedProperties))
 	createdAt := req.CreatedAt
 	if createdAt.IsZero() {
 		createdAt = time.Now()
 	}
 	r := &castleFilterAPIRequest{
-		Type:         req.Event.EventType,
-		Name:         req.Event.Name,
-		Status:       req.Event.EventStatus,
-		RequestToken: req.Context.RequestToken,
-		Params:       params,
-		Context:      req.Context,
-		Properties:   req.Properties,
-		CreatedAt:    createdAt,
+		Type:                 req.Event.EventType,
+		Name:                 req.Event.Name,
+		Status:               req.Event.EventStatus,
+		RequestToken:         req.Context.RequestToken,
+		Params:               params,
+		MatchingUserID:       req.MatchingUserID,
+		Context:              req.Context,
+		Properties:           properties,
+		AuthenticationMethod: req.Event.AuthenticationMethod,
+		Transaction:          req.Event.Transaction,
+		Changeset:            req.Event.Changeset,
+		Product:              req.Product,
+		CreatedAt:            createdAt,
 	}
-	return c.sendCall(ctx, r, FilterEndpoint)
+	return c.sendCall(ctx, r, c.filterURL())
 }
 
 // Risk sends a risk request to castle.io
 // see https://reference.castle.io/#operation/risk for details
+// Failed calls return the action set with WithFailureAction along with the error.
 func (c *Castle) Risk(ctx context.Context, req *Request) (RecommendedAction, error) {
+	return actionOf(c.RiskDecision(ctx, req))
+}
+
+// RiskDecision is the same as Risk but returns the full decision.
+func (c *Castle) RiskDecision(ctx context.Context, req *Request) (*Decision, error) {
 	if req == nil {
-		return RecommendedActionNone, errors.New("request cannot be nil")
+		return nil, errors.New("request cannot be nil")
 	}
+	return c.invoke(ctx, EndpointRisk, req)
+}
+
+func (c *Castle) risk(ctx context.Context, req *Request) (*Decision, error) {
 	if req.Context == nil {
-		return RecommendedActionNone, errors.New("request.Context cannot be nil")
+		return nil, errors.New("request.Context cannot be nil")
 	}
 	createdAt := req.CreatedAt
 	if createdAt.IsZero() {
 		createdAt = time.Now()
 	}
 	r := &castleRiskAPIRequest{
-		Type:         req.Event.EventType,
-		Name:         req.Event.Name,
-		Status:       req.Event.EventStatus,
-		RequestToken: req.Context.RequestToken,
-		User:         req.User,
-		Context:      req.Context,
-		Properties:   req.Properties,
-		CreatedAt:    createdAt,
+		Type:                 req.Event.EventType,
+		Name:                 req.Event.Name,
+		Status:               req.Event.EventStatus,
+		RequestToken:         req.Context.RequestToken,
+		User:                 newCastleAPIUser(req.User, req.IdentityFields),
+		Context:              req.Context,
+		Properties:           mergeProperties(req.Properties, req.TypedProperties),
+		AuthenticationMethod: req.Event.AuthenticationMethod,
+		Transaction:          req.Event.Transaction,
+		Changeset:            req.Event.Changeset,
+		Product:              req.Product,
+		CreatedAt:            createdAt,
+	}
+	return c.sendCall(ctx, r, c.riskURL())
+}
+
+// skipped returns the decision of a call not sent to Castle, with the given fallback or the client's.
+func (c *Castle) skipped(fallback RecommendedAction) *Decision {
+	return &Decision{Action: cmp.Or(fallback, c.fallback), Skipped: true}
+}
+
+// failed returns the decision of a call that failed for lack of a usable answer from Castle, along with its error.
+// There is no decision unless a failure action is set.
+func (c *Castle) failed(err error) (*Decision, error) {
+	if c.failureAction == RecommendedActionNone {
+		return nil, err
+	}
+	return &Decision{Action: c.failureAction, Failed: true}, err
+}
+
+func actionOf(d *Decision, err error) (RecommendedAction, error) {
+	if d == nil {
+		return RecommendedActionNone, err
+	}
+	return d.Action, err
+}
+
+// filterURL returns the filter endpoint configured for this client, falling back to FilterEndpoint.
+func (c *Castle) filterURL() string {
+	if c.filterEndpoint != "" {
+		return c.filterEndpoint
+	}
+	return FilterEndpoint
+}
+
+// riskURL returns the risk endpoint configured for this client, falling back to RiskEndpoint.
+func (c *Castle) riskURL() string {
+	if c.riskEndpoint != "" {
+		return c.riskEndpoint
 	}
-	return c.sendCall(ctx, r, RiskEndpoint)
+	return RiskEndpoint
 }
 
-func (c *Castle) sendCall(ctx context.Context, r castleAPIRequest, url string) (_ RecommendedAction, err error) {
+func (c *Castle) sendCall(ctx context.Context, r castleAPIRequest, url string) (_ *Decision, err error) {
+	skipped := false
 	defer func() {
 		if !c.metricsEnabled {
 			return
 		}
 
 		status := "ok"
-		if err != nil {
+		switch {
+		case skipped:
+			status = "skipped"
+		case err != nil:
 			status = "error"
 		}
-		castleReqsCounter.WithLabelValues(url, status).Inc()
+		castleReqsCounter.WithLabelValues(url, status, c.tenant).Inc()
 	}()
 
-	b := new(bytes.Buffer)
-
-	switch request := r.(type) {
-	case *castleFilterAPIRequest, *castleRiskAPIRequest:
-		err = json.NewEncoder(b).Encode(request)
-	default:
-		err = fmt.Errorf("incorrect request type passed as argument")
+	if c.latency != nil && c.latency.tooLate(ctx) {
+		skipped = true
+		return c.skipped(""), nil
 	}
-	if err != nil {
-		return RecommendedActionNone, err
+
+	e := getEncoder()
+	e.buf = r.appendJSON(e, e.buf)
+	if e.err != nil {
+		err = e.err
+		e.release()
+		return nil, fmt.Errorf("unable to encode request: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, b)
+	defer e.release()
+
+	secret, err := c.secret.Secret(ctx)
 	if err != nil {
-		return RecommendedActionNone, err
+		return c.failed(fmt.Errorf("unable to get castle api secret: %w", err))
 	}
 
-	req.SetBasicAuth("", c.apiSecret)
-	req.Header.Set("content-type", "application/json")
-	req.Header.Set("user-agent", r.GetUserAgent())
-
-	res, err := c.client.Do(req)
+	res, err := c.do(ctx, url, secret, r.GetUserAgent(), e)
 	if err != nil {
-		return RecommendedActionNone, err
+		return c.failed(err)
 	}
-	defer res.Body.Close() // nolint: gosec
+	defer func() {
+		// drain what the decoder left unread, so the connection can be reused
+		io.Copy(io.Discard, io.LimitReader(res.Body, maxPooledBuffer)) // nolint: errcheck
+		res.Body.Close()                                               // nolint: errcheck,gosec
+	}()
 	if res.StatusCode != http.StatusCreated {
 		b, _ := io.ReadAll(res.Body) // nolint: errcheck
 
-		return RecommendedActionNone, &APIError{
+		apiErr := &APIError{
 			StatusCode: res.StatusCode,
 			Message:    string(b),
 		}
+		if serverError(res.StatusCode) {
+			return c.failed(apiErr)
+		}
+		return nil, apiErr
 	}
 
 	resp := &castleAPIResponse{}
 	if err = json.NewDecoder(res.Body).Decode(resp); err != nil {
-		return RecommendedActionNone, fmt.Errorf("unable to decode response body: %w", err)
+		return c.failed(fmt.Errorf("unable to decode response body: %w", err))
+	}
+
+	return &Decision{
+		Action:           recommendedActionFromString(resp.Policy.Action),
+		Risk:             resp.Risk,
+		PolicyName:       resp.Policy.Name,
+		PolicyID:         resp.Policy.ID,
+		PolicyRevisionID: resp.Policy.RevisionID,
+		DeviceToken:      resp.Device.Token,
+	}, nil
+}
+
+// do sends the encoded request, retrying network errors, 429 and 5xx responses as configured with WithRetries.
+// The transports close the bodies once they are done with them, which releases the encoder.
+func (c *Castle) do(ctx context.Context, url, secret, userAgent string, e *encoder) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		body := e.body()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+		if err != nil {
+			body.Close() // nolint: errcheck,gosec
+			return nil, err
+		}
+		req.ContentLength = int64(len(e.buf))
+		// lets the transport replay the request itself, e.g. after an HTTP/2 GOAWAY
+		req.GetBody = func() (io.ReadCloser, error) {
+			return e.body(), nil
+		}
+		req.SetBasicAuth("", secret)
+		req.Header.Set("content-type", "application/json")
+		req.Header.Set("user-agent", userAgent)
+
+		start := time.Now()
+		res, err := c.client.Do(req)
+		// failed attempts count too, or a slow Castle would only be measured by the calls fast enough to succeed,
+		// unless the caller gave up on the call
+		if c.latency != nil && (err == nil || !errors.Is(ctx.Err(), context.Canceled)) {
+			c.latency.record(c.elapsed(ctx, start))
+		}
+		if attempt >= c.retries || !retryable(ctx, res, err) {
+			return res, err
+		}
+		if res != nil {
+			io.Copy(io.Discard, io.LimitReader(res.Body, maxPooledBuffer)) // nolint: errcheck
+			res.Body.Close()                                               // nolint: errcheck,gosec
+		}
+
+		timer := time.NewTimer(c.retryBackoff << attempt)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
 	}
+}
+
+// elapsed returns the time since start, capped at the deadline of ctx and the client timeout, so attempts that
+// timed out are recorded as taking as long as they were allowed to.
+func (c *Castle) elapsed(ctx context.Context, start time.Time) time.Duration {
+	d := time.Since(start)
+	if deadline, ok := ctx.Deadline(); ok {
+		d = min(d, max(deadline.Sub(start), 0))
+	}
+	if c.client.Timeout > 0 {
+		d = min(d, c.client.Timeout)
+	}
+	return d
+}
+
+func retryable(ctx context.Context, res *http.Response, err error) bool {
+	if err != nil {
+		return ctx.Err() == nil
+	}
+	return serverError(res.StatusCode)
+}
 
-	return recommendedActionFromString(resp.Policy.Action), nil
+// serverError reports whether the status code means Castle is unavailable or overloaded.
+func serverError(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
 }
 
 func recommendedActionFromString(action string) RecommendedAction {
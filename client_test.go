@@ -3,8 +3,10 @@ package castle_test
 import (
 	"context"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -384,3 +386,429 @@ func TestCastle_SendRiskCall(t *testing.T) {
 		assert.Equal(t, castle.RecommendedActionDeny, res)
 	})
 }
+
+func TestCastle_TypedProperties(t *testing.T) {
+	ctx := context.Background()
+
+	req := configureRequest(configureHTTPRequest())
+	req.TypedProperties = castle.Properties{}.
+		Set("basket_value", 12.5).
+		Set("prop1", true)
+	req.User.TypedTraits = castle.Properties{}.Set("account_age_days", 42)
+
+	got := map[string]any{}
+	cstl := newCapturingClient(t, got)
+
+	expectedProperties := map[string]any{"prop1": true, "basket_value": 12.5}
+
+	t.Run("filter", func(t *testing.T) {
+		_, err := cstl.Filter(ctx, req)
+		require.NoError(t, err)
+
+		assert.Equal(t, expectedProperties, got["properties"])
+	})
+
+	t.Run("risk", func(t *testing.T) {
+		_, err := cstl.Risk(ctx, req)
+		require.NoError(t, err)
+
+		assert.Equal(t, expectedProperties, got["properties"])
+		assert.Equal(t, map[string]any{"trait1": "traitValue1", "account_age_days": float64(42)}, got["user"].(map[string]any)["traits"])
+	})
+}
+
+func TestCastle_EventDetails(t *testing.T) {
+	ctx := context.Background()
+
+	req := configureRequest(configureHTTPRequest())
+	req.Event = castle.Event{
+		EventType:   castle.EventTypeTransaction,
+		EventStatus: castle.EventStatusAttempted,
+		AuthenticationMethod: &castle.AuthenticationMethod{
+			Type:    castle.AuthenticationMethodAuthenticator,
+			Variant: "totp",
+		},
+		Transaction: &castle.Transaction{
+			ID:     "tx-1",
+			Amount: castle.Amount{Type: castle.AmountTypeFiat, Value: "49.99", Currency: "GBP"},
+		},
+		Changeset: map[string]castle.Change{"password": {Changed: true}},
+	}
+	req.Product = &castle.Product{ID: "energy"}
+	req.MatchingUserID = "matching-user-id"
+
+	got := map[string]any{}
+	cstl := newCapturingClient(t, got)
+
+	assertEventDetails := func(t *testing.T) {
+		t.Helper()
+		assert.Equal(t, "$transaction", got["type"])
+		assert.Equal(t, map[string]any{"type": "$authenticator", "variant": "totp"}, got["authentication_method"])
+		assert.Equal(t, map[string]any{
+			"id":     "tx-1",
+			"amount": map[string]any{"type": "$fiat", "value": "49.99", "currency": "GBP"},
+		}, got["transaction"])
+		assert.Equal(t, map[string]any{"password": map[string]any{"changed": true}}, got["changeset"])
+		assert.Equal(t, map[string]any{"id": "energy"}, got["product"])
+	}
+
+	t.Run("filter", func(t *testing.T) {
+		_, err := cstl.Filter(ctx, req)
+		require.NoError(t, err)
+
+		assertEventDetails(t)
+		assert.Equal(t, "matching-user-id", got["matching_user_id"])
+	})
+
+	t.Run("risk", func(t *testing.T) {
+		_, err := cstl.Risk(ctx, req)
+		require.NoError(t, err)
+
+		assertEventDetails(t)
+		assert.NotContains(t, got, "matching_user_id")
+	})
+}
+
+// newCapturingClient returns a client whose requests are decoded into got, replacing its previous content.
+func newCapturingClient(t *testing.T, got map[string]any, opts ...castle.Opt) *castle.Castle {
+	t.Helper()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clear(got)
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+
+		w.WriteHeader(http.StatusCreated)
+		_, err := w.Write([]byte(`{"policy": {"action": "allow"}}`))
+		require.NoError(t, err)
+	}))
+	t.Cleanup(ts.Close)
+
+	cstl, err := castle.New("secret-string", append([]castle.Opt{castle.WithEndpoints(ts.URL, ts.URL)}, opts...)...)
+	require.NoError(t, err)
+	return cstl
+}
+
+func TestCastle_IdentityFields(t *testing.T) {
+	ctx := context.Background()
+
+	req := configureRequest(configureHTTPRequest())
+	req.Properties = nil
+	req.User = castle.User{
+		ID:      "user-id",
+		Email:   "user@test.com",
+		Phone:   "+447700900000",
+		Name:    "Jane Doe",
+		Address: &castle.Address{City: "London", Postcode: "NW1 1AA", Country: "GB"},
+	}
+	address := map[string]any{"city": "London", "postal_code": "NW1 1AA", "country_code": "GB"}
+
+	got := map[string]any{}
+	cstl := newCapturingClient(t, got)
+
+	t.Run("filter maps all identity fields to params", func(t *testing.T) {
+		_, err := cstl.Filter(ctx, req)
+		require.NoError(t, err)
+
+		assert.Equal(t, map[string]any{
+			"email":    "user@test.com",
+			"phone":    "+447700900000",
+			"username": "user-id",
+			"address":  address,
+		}, got["params"])
+		assert.NotContains(t, got, "properties")
+	})
+
+	t.Run("risk maps all identity fields to user", func(t *testing.T) {
+		_, err := cstl.Risk(ctx, req)
+		require.NoError(t, err)
+
+		assert.Equal(t, map[string]any{
+			"id":      "user-id",
+			"email":   "user@test.com",
+			"phone":   "+447700900000",
+			"name":    "Jane Doe",
+			"address": address,
+		}, got["user"])
+	})
+
+	req.IdentityFields = []castle.UserField{castle.UserFieldEmail}
+
+	t.Run("filter sends other fields as properties", func(t *testing.T) {
+		_, err := cstl.Filter(ctx, req)
+		require.NoError(t, err)
+
+		assert.Equal(t, map[string]any{"email": "user@test.com"}, got["params"])
+		assert.Equal(t, map[string]any{
+			"id":      "user-id",
+			"phone":   "+447700900000",
+			"name":    "Jane Doe",
+			"address": address,
+		}, got["properties"])
+	})
+
+	t.Run("risk sends other fields as traits", func(t *testing.T) {
+		_, err := cstl.Risk(ctx, req)
+		require.NoError(t, err)
+
+		assert.Equal(t, map[string]any{
+			"id":    "user-id",
+			"email": "user@test.com",
+			"traits": map[string]any{
+				"phone":   "+447700900000",
+				"name":    "Jane Doe",
+				"address": address,
+			},
+		}, got["user"])
+	})
+}
+
+func TestCastle_Decision(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, err := w.Write([]byte(`{
+			"risk": 0.65,
+			"policy": {"action": "challenge", "name": "Challenge risky logins", "id": "policy-id", "revision_id": "revision-id"},
+			"device": {"token": "device-token"}
+		}`))
+		require.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	cstl, err := castle.New("secret-string", castle.WithEndpoints(ts.URL, ts.URL))
+	require.NoError(t, err)
+
+	expected := &castle.Decision{
+		Action:           castle.RecommendedActionChallenge,
+		Risk:             0.65,
+		PolicyName:       "Challenge risky logins",
+		PolicyID:         "policy-id",
+		PolicyRevisionID: "revision-id",
+		DeviceToken:      "device-token",
+	}
+
+	req := configureRequest(configureHTTPRequest())
+
+	got, err := cstl.RiskDecision(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, expected, got)
+
+	got, err = cstl.FilterDecision(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, expected, got)
+}
+
+func TestCastle_Retries(t *testing.T) {
+	t.Run("retries server errors with the same body", func(t *testing.T) {
+		var bodies []string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			bodies = append(bodies, string(b))
+			if len(bodies) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			_, err = w.Write([]byte(`{"policy":{"action":"allow"}}`))
+			require.NoError(t, err)
+		}))
+		defer ts.Close()
+
+		cstl, err := castle.New("secret-string", castle.WithEndpoints(ts.URL, ts.URL), castle.WithRetries(2, time.Millisecond))
+		require.NoError(t, err)
+
+		res, err := cstl.Filter(context.Background(), configureRequest(configureHTTPRequest()))
+		require.NoError(t, err)
+		assert.Equal(t, castle.RecommendedActionAllow, res)
+		require.Len(t, bodies, 3)
+		assert.Equal(t, bodies[0], bodies[1])
+		assert.Equal(t, bodies[0], bodies[2])
+	})
+
+	t.Run("gives up after the last retry", func(t *testing.T) {
+		calls := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+		defer ts.Close()
+
+		cstl, err := castle.New("secret-string", castle.WithEndpoints(ts.URL, ts.URL), castle.WithRetries(1, time.Millisecond))
+		require.NoError(t, err)
+
+		_, err = cstl.Risk(context.Background(), configureRequest(configureHTTPRequest()))
+		var apiErr *castle.APIError
+		require.ErrorAs(t, err, &apiErr)
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("does not retry client errors", func(t *testing.T) {
+		calls := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer ts.Close()
+
+		cstl, err := castle.New("secret-string", castle.WithEndpoints(ts.URL, ts.URL), castle.WithRetries(3, time.Millisecond))
+		require.NoError(t, err)
+
+		_, err = cstl.Filter(context.Background(), configureRequest(configureHTTPRequest()))
+		require.Error(t, err)
+		assert.Equal(t, 1, calls)
+	})
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestCastle_GetBody(t *testing.T) {
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		require.NotNil(t, r.GetBody)
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.NoError(t, r.Body.Close())
+
+		// the transport replays the request from GetBody, e.g. when an HTTP/2 stream was refused
+		replay, err := r.GetBody()
+		require.NoError(t, err)
+		replayed, err := io.ReadAll(replay)
+		require.NoError(t, err)
+		require.NoError(t, replay.Close())
+		assert.Equal(t, string(body), string(replayed))
+		assert.Equal(t, r.ContentLength, int64(len(replayed)))
+
+		return &http.Response{
+			StatusCode: http.StatusCreated,
+			Body:       io.NopCloser(strings.NewReader(`{"policy":{"action":"allow"}}`)),
+		}, nil
+	})}
+
+	cstl, err := castle.NewWithHTTPClient("secret-string", client)
+	require.NoError(t, err)
+
+	res, err := cstl.Filter(context.Background(), configureRequest(configureHTTPRequest()))
+	require.NoError(t, err)
+	assert.Equal(t, castle.RecommendedActionAllow, res)
+}
+
+func TestCastle_FailureAction(t *testing.T) {
+	newServer := func(t *testing.T, status int, body string) string {
+		t.Helper()
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(status)
+			_, err := w.Write([]byte(body))
+			require.NoError(t, err)
+		}))
+		t.Cleanup(ts.Close)
+		return ts.URL
+	}
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := map[string]struct {
+		url            string
+		expectedAction castle.RecommendedAction
+	}{
+		"server error": {
+			url:            newServer(t, http.StatusServiceUnavailable, ""),
+			expectedAction: castle.RecommendedActionDeny,
+		},
+		"rate limited": {
+			url:            newServer(t, http.StatusTooManyRequests, ""),
+			expectedAction: castle.RecommendedActionDeny,
+		},
+		"undecodable response": {
+			url:            newServer(t, http.StatusCreated, "{"),
+			expectedAction: castle.RecommendedActionDeny,
+		},
+		"network error": {
+			url:            closed.URL,
+			expectedAction: castle.RecommendedActionDeny,
+		},
+		"client error": {
+			url:            newServer(t, http.StatusBadRequest, ""),
+			expectedAction: castle.RecommendedActionNone,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cstl, err := castle.New("secret-string", castle.WithEndpoints(test.url, test.url), castle.WithFailureAction(castle.RecommendedActionDeny))
+			require.NoError(t, err)
+
+			res, err := cstl.Filter(context.Background(), configureRequest(configureHTTPRequest()))
+			require.Error(t, err)
+			assert.Equal(t, test.expectedAction, res)
+
+			d, err := cstl.RiskDecision(context.Background(), configureRequest(configureHTTPRequest()))
+			require.Error(t, err)
+			if test.expectedAction == castle.RecommendedActionNone {
+				assert.Nil(t, d)
+			} else {
+				assert.Equal(t, &castle.Decision{Action: test.expectedAction, Failed: true}, d)
+			}
+		})
+	}
+
+	t.Run("secret provider error", func(t *testing.T) {
+		url := newServer(t, http.StatusCreated, `{"policy":{"action":"allow"}}`)
+		cstl, err := castle.New("",
+			castle.WithSecretProvider(castle.EnvSecret("CASTLE_GO_TEST_UNSET_SECRET")),
+			castle.WithEndpoints(url, url),
+			castle.WithFailureAction(castle.RecommendedActionDeny),
+		)
+		require.NoError(t, err)
+
+		d, err := cstl.FilterDecision(context.Background(), configureRequest(configureHTTPRequest()))
+		require.ErrorContains(t, err, "unable to get castle api secret")
+		assert.Equal(t, &castle.Decision{Action: castle.RecommendedActionDeny, Failed: true}, d)
+	})
+
+	t.Run("no failure action", func(t *testing.T) {
+		url := newServer(t, http.StatusServiceUnavailable, "")
+		cstl, err := castle.New("secret-string", castle.WithEndpoints(url, url))
+		require.NoError(t, err)
+
+		d, err := cstl.FilterDecision(context.Background(), configureRequest(configureHTTPRequest()))
+		require.Error(t, err)
+		assert.Nil(t, d)
+	})
+}
+
+// staticTransport answers every request with the same response without any network round trip.
+type staticTransport struct {
+	body string
+}
+
+func (t staticTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if _, err := io.Copy(io.Discard, r.Body); err != nil {
+		return nil, err
+	}
+	if err := r.Body.Close(); err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusCreated,
+		Body:       io.NopCloser(strings.NewReader(t.body)),
+		Request:    r,
+	}, nil
+}
+
+func BenchmarkCastle_Filter(b *testing.B) {
+	client := &http.Client{Transport: staticTransport{body: `{"risk": 0.1, "policy": {"action": "allow"}, "device": {"token": "device-token"}}`}}
+	cstl, err := castle.NewWithHTTPClient("secret-string", client, castle.WithMetrics(false))
+	require.NoError(b, err)
+
+	req := configureRequest(configureHTTPRequest())
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := cstl.Filter(ctx, req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
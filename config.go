@@ -0,0 +1,175 @@
+package castle
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variables read by ConfigFromEnv.
+const (
+	EnvAPISecret     = "CASTLE_API_SECRET"
+	EnvAPISecretFile = "CASTLE_API_SECRET_FILE"
+	EnvBaseURL       = "CASTLE_BASE_URL"
+	EnvTimeout       = "CASTLE_TIMEOUT"
+	EnvRetries       = "CASTLE_RETRIES"
+	EnvRetryBackoff  = "CASTLE_RETRY_BACKOFF"
+	EnvMetrics       = "CASTLE_METRICS"
+	EnvFallback      = "CASTLE_FALLBACK"
+	EnvFailureAction = "CASTLE_FAILURE_ACTION"
+	EnvLatencyBudget = "CASTLE_LATENCY_BUDGET"
+)
+
+const defaultRetryBackoff = 100 * time.Millisecond
+
+// Config is the configuration of a client read from the environment, see ConfigFromEnv.
+type Config struct {
+	// Secret is the API secret, from CASTLE_API_SECRET.
+	Secret string
+	// SecretFile is the path of a file holding the API secret, from CASTLE_API_SECRET_FILE. See FileSecret.
+	SecretFile string
+	// BaseURL replaces https://api.castle.io in the endpoints, from CASTLE_BASE_URL.
+	BaseURL string
+	// Timeout bounds every request, from CASTLE_TIMEOUT, e.g. "2s". It defaults to DefaultTimeout.
+	Timeout time.Duration
+	// Retries is the number of retries of failed calls, from CASTLE_RETRIES. It defaults to none.
+	Retries int
+	// RetryBackoff is the wait before the first retry, from CASTLE_RETRY_BACKOFF. It defaults to 100ms.
+	RetryBackoff time.Duration
+	// Metrics enables metrics, from CASTLE_METRICS. It defaults to true.
+	Metrics bool
+	// Fallback is the action returned for calls skipped by the latency budget or sampling, from CASTLE_FALLBACK,
+	// i.e. allow, deny or challenge. See WithFallback.
+	Fallback RecommendedAction
+	// FailureAction is the action returned along with the error of failed calls, from CASTLE_FAILURE_ACTION,
+	// i.e. allow to fail open, deny to fail closed or challenge. See WithFailureAction.
+	FailureAction RecommendedAction
+	// LatencyBudget is the latency percentile calls are skipped under, from CASTLE_LATENCY_BUDGET, e.g. "0.95".
+	// It is disabled by default. See WithLatencyBudget.
+	LatencyBudget float64
+}
+
+// ConfigFromEnv reads and validates the configuration from the environment. Either CASTLE_API_SECRET or
+// CASTLE_API_SECRET_FILE is required, the other variables are optional. All the misconfigured variables
+// are reported at once.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{
+		Timeout:      DefaultTimeout,
+		RetryBackoff: defaultRetryBackoff,
+		Metrics:      true,
+	}
+	var errs []error
+
+	cfg.Secret = os.Getenv(EnvAPISecret)
+	cfg.SecretFile = os.Getenv(EnvAPISecretFile)
+	switch {
+	case cfg.Secret == "" && cfg.SecretFile == "":
+		errs = append(errs, fmt.Errorf("%s or %s is required", EnvAPISecret, EnvAPISecretFile))
+	case cfg.Secret != "" && cfg.SecretFile != "":
+		errs = append(errs, fmt.Errorf("only one of %s and %s can be set", EnvAPISecret, EnvAPISecretFile))
+	}
+
+	if v := os.Getenv(EnvBaseURL); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s must be an http or https URL, got %q", EnvBaseURL, v))
+		}
+		cfg.BaseURL = strings.TrimSuffix(v, "/")
+	}
+
+	if v := os.Getenv(EnvTimeout); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be a positive duration, got %q", EnvTimeout, v))
+		}
+		cfg.Timeout = d
+	}
+
+	if v := os.Getenv(EnvRetries); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			errs = append(errs, fmt.Errorf("%s must be a non-negative integer, got %q", EnvRetries, v))
+		}
+		cfg.Retries = n
+	}
+
+	if v := os.Getenv(EnvRetryBackoff); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			errs = append(errs, fmt.Errorf("%s must be a non-negative duration, got %q", EnvRetryBackoff, v))
+		}
+		cfg.RetryBackoff = d
+	}
+
+	if v := os.Getenv(EnvMetrics); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s must be a boolean, got %q", EnvMetrics, v))
+		}
+		cfg.Metrics = b
+	}
+
+	cfg.Fallback, errs = envAction(EnvFallback, errs)
+	cfg.FailureAction, errs = envAction(EnvFailureAction, errs)
+
+	if v := os.Getenv(EnvLatencyBudget); v != "" {
+		p, err := strconv.ParseFloat(v, 64)
+		if err != nil || p <= 0 || p > 1 {
+			errs = append(errs, fmt.Errorf("%s must be a percentile between 0 and 1, got %q", EnvLatencyBudget, v))
+		}
+		cfg.LatencyBudget = p
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return Config{}, fmt.Errorf("invalid castle configuration: %w", err)
+	}
+	return cfg, nil
+}
+
+// envAction reads an action from the environment variable name, appending to errs if it is not a known action.
+func envAction(name string, errs []error) (RecommendedAction, []error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return RecommendedActionNone, errs
+	}
+	action := recommendedActionFromString(strings.ToLower(v))
+	if action == RecommendedActionNone {
+		errs = append(errs, fmt.Errorf("%s must be one of allow, deny or challenge, got %q", name, v))
+	}
+	return action, errs
+}
+
+// Options returns the options applying the configuration, except for the static secret passed to New.
+func (cfg Config) Options() []Opt {
+	opts := []Opt{
+		WithTimeout(cfg.Timeout),
+		WithRetries(cfg.Retries, cfg.RetryBackoff),
+		WithMetrics(cfg.Metrics),
+		WithFallback(cfg.Fallback),
+		WithFailureAction(cfg.FailureAction),
+	}
+	if cfg.SecretFile != "" {
+		opts = append(opts, WithSecretProvider(NewFileSecret(cfg.SecretFile)))
+	}
+	if cfg.BaseURL != "" {
+		opts = append(opts, WithEndpoints(cfg.BaseURL+"/v1/filter", cfg.BaseURL+"/v1/risk"))
+	}
+	if cfg.LatencyBudget > 0 {
+		opts = append(opts, WithLatencyBudget(cfg.LatencyBudget))
+	}
+	return opts
+}
+
+// NewFromEnv creates a client configured from the environment, see ConfigFromEnv.
+// The options passed are applied after the configuration, so they take precedence.
+func NewFromEnv(opts ...Opt) (*Castle, error) {
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return New(cfg.Secret, append(cfg.Options(), opts...)...)
+}
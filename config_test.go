@@ -0,0 +1,127 @@
+package castle_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/utilitywarehouse/castle-go"
+)
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		t.Setenv(castle.EnvAPISecret, "secret-string")
+
+		cfg, err := castle.ConfigFromEnv()
+		require.NoError(t, err)
+		assert.Equal(t, castle.Config{
+			Secret:       "secret-string",
+			Timeout:      castle.DefaultTimeout,
+			RetryBackoff: 100 * time.Millisecond,
+			Metrics:      true,
+		}, cfg)
+	})
+
+	t.Run("all variables", func(t *testing.T) {
+		t.Setenv(castle.EnvAPISecretFile, "/etc/castle/api-secret")
+		t.Setenv(castle.EnvBaseURL, "https://castle.example.com/")
+		t.Setenv(castle.EnvTimeout, "2s")
+		t.Setenv(castle.EnvRetries, "2")
+		t.Setenv(castle.EnvRetryBackoff, "50ms")
+		t.Setenv(castle.EnvMetrics, "false")
+		t.Setenv(castle.EnvFallback, "Allow")
+		t.Setenv(castle.EnvFailureAction, "deny")
+		t.Setenv(castle.EnvLatencyBudget, "0.95")
+
+		cfg, err := castle.ConfigFromEnv()
+		require.NoError(t, err)
+		assert.Equal(t, castle.Config{
+			SecretFile:    "/etc/castle/api-secret",
+			BaseURL:       "https://castle.example.com",
+			Timeout:       2 * time.Second,
+			Retries:       2,
+			RetryBackoff:  50 * time.Millisecond,
+			Metrics:       false,
+			Fallback:      castle.RecommendedActionAllow,
+			FailureAction: castle.RecommendedActionDeny,
+			LatencyBudget: 0.95,
+		}, cfg)
+	})
+
+	t.Run("secret is required", func(t *testing.T) {
+		_, err := castle.ConfigFromEnv()
+		require.ErrorContains(t, err, "CASTLE_API_SECRET or CASTLE_API_SECRET_FILE is required")
+	})
+
+	t.Run("secret and secret file are exclusive", func(t *testing.T) {
+		t.Setenv(castle.EnvAPISecret, "secret-string")
+		t.Setenv(castle.EnvAPISecretFile, "/etc/castle/api-secret")
+
+		_, err := castle.ConfigFromEnv()
+		require.ErrorContains(t, err, "only one of CASTLE_API_SECRET and CASTLE_API_SECRET_FILE can be set")
+	})
+
+	t.Run("reports every invalid variable", func(t *testing.T) {
+		t.Setenv(castle.EnvAPISecret, "secret-string")
+		t.Setenv(castle.EnvBaseURL, "castle.example.com")
+		t.Setenv(castle.EnvTimeout, "0s")
+		t.Setenv(castle.EnvRetries, "-1")
+		t.Setenv(castle.EnvRetryBackoff, "soon")
+		t.Setenv(castle.EnvMetrics, "maybe")
+		t.Setenv(castle.EnvFallback, "none")
+		t.Setenv(castle.EnvFailureAction, "open")
+		t.Setenv(castle.EnvLatencyBudget, "95")
+
+		cfg, err := castle.ConfigFromEnv()
+		require.Error(t, err)
+		assert.Equal(t, castle.Config{}, cfg)
+		for _, v := range []string{
+			castle.EnvBaseURL, castle.EnvTimeout, castle.EnvRetries, castle.EnvRetryBackoff,
+			castle.EnvMetrics, castle.EnvFallback, castle.EnvFailureAction, castle.EnvLatencyBudget,
+		} {
+			assert.ErrorContains(t, err, v)
+		}
+	})
+}
+
+func TestNewFromEnv(t *testing.T) {
+	var gotPath, gotSecret string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		_, gotSecret, _ = r.BasicAuth()
+		w.WriteHeader(http.StatusCreated)
+		_, err := w.Write([]byte(`{"policy":{"action":"deny"}}`))
+		require.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	secretFile := filepath.Join(t.TempDir(), "api-secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte("file-secret\n"), 0o600))
+
+	t.Setenv(castle.EnvAPISecretFile, secretFile)
+	t.Setenv(castle.EnvBaseURL, ts.URL)
+	t.Setenv(castle.EnvMetrics, "false")
+
+	cstl, err := castle.NewFromEnv()
+	require.NoError(t, err)
+
+	res, err := cstl.Risk(context.Background(), configureRequest(configureHTTPRequest()))
+	require.NoError(t, err)
+	assert.Equal(t, castle.RecommendedActionDeny, res)
+	assert.Equal(t, "/v1/risk", gotPath)
+	assert.Equal(t, "file-secret", gotSecret)
+
+	t.Run("invalid environment", func(t *testing.T) {
+		t.Setenv(castle.EnvAPISecretFile, "")
+
+		_, err := castle.NewFromEnv()
+		require.ErrorContains(t, err, "invalid castle configuration")
+	})
+}
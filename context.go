@@ -3,7 +3,6 @@ package castle
 import (
 	"context"
 	"net/http"
-	"strings"
 
 	http_internal "github.com/utilitywarehouse/castle-go/http"
 )
@@ -22,6 +21,10 @@ func (c contextKey) String() string {
 
 var castleCtxKey = contextKey("castle_context")
 
+// DefaultClientIP extracts the client IP for FromHTTPRequest and Middleware unless WithClientIP is passed.
+// Replace it with the IPFromRequest method of a http.IPResolver when running behind trusted proxies.
+var DefaultClientIP = http_internal.IPFromRequest
+
 // ToCtx adds the Castle context to the context.Context.
 func ToCtx(ctx context.Context, castleCtx *Context) context.Context {
 	return context.WithValue(ctx, castleCtxKey, castleCtx)
@@ -36,65 +39,34 @@ func FromCtx(ctx context.Context) *Context {
 	return nil
 }
 
+// FromHTTPRequest builds the Castle context from the request, forwarding headers allowed by DefaultHeaderPolicy.
 func FromHTTPRequest(r *http.Request) *Context {
-	return &Context{
-		RequestToken: func() string {
-			// grab the token from header if it exists
-			if tkn := tokenFromHTTPHeader(r.Header); tkn != "" {
-				return tkn
-			}
-
-			// otherwise, try grabbing it from form
-			return tokenFromHTTPForm(r)
-		}(),
-		IP:      http_internal.IPFromRequest(r),
-		Headers: filterHeader(r.Header), // pass in as much context as possible
-	}
+	return FromHTTPRequestWithPolicy(r, DefaultHeaderPolicy)
 }
 
-// ToCtxFromHTTPRequest adds the token and other request information (i.e. castle context) to the context.
-func ToCtxFromHTTPRequest(ctx context.Context, r *http.Request) context.Context {
-	return ToCtx(ctx, FromHTTPRequest(r))
+// FromHTTPRequestWithPolicy same as FromHTTPRequest but forwards headers allowed by the given policy.
+func FromHTTPRequestWithPolicy(r *http.Request, policy *HeaderPolicy) *Context {
+	return fromHTTPRequest(r, policy, nil, nil)
 }
 
-func tokenFromHTTPHeader(header http.Header) string {
-	for _, name := range validTokenHeaderNames {
-		if t := header.Get(name); t != "" {
-			return t
-		}
+func fromHTTPRequest(r *http.Request, policy *HeaderPolicy, clientIP func(*http.Request) string, token TokenExtractor) *Context {
+	if policy == nil {
+		policy = DefaultHeaderPolicy
 	}
-	return ""
-}
-
-func tokenFromHTTPForm(r *http.Request) string {
-	// ParseForm is idempotent, so it's safe to call from anywhere
-	if err := r.ParseForm(); err != nil {
-		return ""
+	if clientIP == nil {
+		clientIP = DefaultClientIP
 	}
-
-	for _, name := range validTokenFormNames {
-		if t := r.Form.Get(name); t != "" {
-			return t
-		}
+	if token == nil {
+		token = DefaultTokenExtractor
 	}
-	return ""
-}
-
-func filterHeader(hs http.Header) map[string]string {
-	castleHeaders := make(map[string]string)
-	for key, value := range hs {
-		// Ensure cookies or authorization are never sent along.
-		// Everything else is fair game.
-		if _, ok := disallowedHeaders[strings.ToLower(key)]; ok {
-			continue
-		}
-		// View: https://www.w3.org/Protocols/rfc2616/rfc2616-sec4.html
-		castleHeaders[key] = strings.Join(value, ", ")
+	return &Context{
+		RequestToken: token(r),
+		IP:           clientIP(r),
+		Headers:      policy.Filter(r.Header), // pass in as much context as possible
 	}
-	return castleHeaders
 }
 
-var disallowedHeaders = map[string]struct{}{
-	"cookie":        {},
-	"authorization": {},
+// ToCtxFromHTTPRequest adds the token and other request information (i.e. castle context) to the context.
+func ToCtxFromHTTPRequest(ctx context.Context, r *http.Request) context.Context {
+	return ToCtx(ctx, FromHTTPRequest(r))
 }
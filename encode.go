@@ -0,0 +1,467 @@
+package castle
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// maxPooledBuffer keeps unusually large requests from pinning their buffer in the pool.
+const maxPooledBuffer = 64 << 10
+
+var encoderPool = sync.Pool{
+	New: func() any {
+		return &encoder{buf: make([]byte, 0, 2048)}
+	},
+}
+
+// encoder writes API requests as JSON without reflection. The buffer goes back to the pool only once both the
+// caller and the bodies of every attempt are done with it, which can be after the round trip returns.
+//
+// The output is the same as encoding/json, including sorted map keys and HTML escaping.
+type encoder struct {
+	buf  []byte
+	keys []string
+	err  error
+	refs atomic.Int32
+}
+
+func getEncoder() *encoder {
+	e := encoderPool.Get().(*encoder) // nolint: errcheck
+	e.buf = e.buf[:0]
+	e.err = nil
+	e.refs.Store(1)
+	return e
+}
+
+// release drops a reference, the last one puts the encoder back in the pool.
+func (e *encoder) release() {
+	if e.refs.Add(-1) != 0 {
+		return
+	}
+	if cap(e.buf) > maxPooledBuffer {
+		return
+	}
+	clear(e.keys)
+	e.keys = e.keys[:0]
+	encoderPool.Put(e)
+}
+
+// body returns the encoded request as the body of an attempt. Every attempt gets its own body, so a late Close
+// by the transport, e.g. from the write loop after the round trip failed, can't touch an encoder already reused.
+func (e *encoder) body() io.ReadCloser {
+	e.refs.Add(1)
+	b := &requestBody{e: e}
+	b.r.Reset(e.buf)
+	return b
+}
+
+// requestBody holds a reference to the encoder until it is closed. Reads and Close are serialised, so the buffer
+// is never read once it may be back in the pool.
+type requestBody struct {
+	mu sync.Mutex
+	r  bytes.Reader
+	e  *encoder
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.e == nil {
+		return 0, http.ErrBodyReadAfterClose
+	}
+	return b.r.Read(p)
+}
+
+// Close releases the reference of the attempt, only the first call has an effect.
+func (b *requestBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.e != nil {
+		b.r.Reset(nil)
+		b.e.release()
+		b.e = nil
+	}
+	return nil
+}
+
+func (r *castleFilterAPIRequest) appendJSON(e *encoder, b []byte) []byte {
+	b = append(b, `{"type":`...)
+	b = appendString(b, string(r.Type))
+	if r.Name != "" {
+		b = append(b, `,"name":`...)
+		b = appendString(b, r.Name)
+	}
+	b = append(b, `,"status":`...)
+	b = appendString(b, string(r.Status))
+	b = append(b, `,"request_token":`...)
+	b = appendString(b, r.RequestToken)
+	b = append(b, `,"params":`...)
+	b = appendParams(b, &r.Params)
+	if r.MatchingUserID != "" {
+		b = append(b, `,"matching_user_id":`...)
+		b = appendString(b, r.MatchingUserID)
+	}
+	b = append(b, `,"context":`...)
+	b = appendContext(e, b, r.Context)
+	b = appendEventDetails(e, b, r.Properties, r.AuthenticationMethod, r.Transaction, r.Changeset, r.Product)
+	b = append(b, `,"created_at":`...)
+	b = appendTime(b, r.CreatedAt)
+	return append(b, '}')
+}
+
+func (r *castleRiskAPIRequest) appendJSON(e *encoder, b []byte) []byte {
+	b = append(b, `{"type":`...)
+	b = appendString(b, string(r.Type))
+	if r.Name != "" {
+		b = append(b, `,"name":`...)
+		b = appendString(b, r.Name)
+	}
+	b = append(b, `,"status":`...)
+	b = appendString(b, string(r.Status))
+	b = append(b, `,"request_token":`...)
+	b = appendString(b, r.RequestToken)
+	b = append(b, `,"user":`...)
+	b = appendUser(e, b, &r.User)
+	b = append(b, `,"context":`...)
+	b = appendContext(e, b, r.Context)
+	b = appendEventDetails(e, b, r.Properties, r.AuthenticationMethod, r.Transaction, r.Changeset, r.Product)
+	b = append(b, `,"created_at":`...)
+	b = appendTime(b, r.CreatedAt)
+	return append(b, '}')
+}
+
+// appendEventDetails appends the optional fields shared by Filter and Risk requests.
+func appendEventDetails(e *encoder, b []byte, properties map[string]any, am *AuthenticationMethod, t *Transaction, changeset map[string]Change, p *Product) []byte {
+	if len(properties) > 0 {
+		b = append(b, `,"properties":`...)
+		b = appendAnyMap(e, b, properties)
+	}
+	if am != nil {
+		b = append(b, `,"authentication_method":{"type":`...)
+		b = appendString(b, string(am.Type))
+		if am.Variant != "" {
+			b = append(b, `,"variant":`...)
+			b = appendString(b, am.Variant)
+		}
+		b = append(b, '}')
+	}
+	if t != nil {
+		b = append(b, `,"transaction":{`...)
+		if t.ID != "" {
+			b = append(b, `"id":`...)
+			b = appendString(b, t.ID)
+			b = append(b, ',')
+		}
+		b = append(b, `"amount":{"type":`...)
+		b = appendString(b, string(t.Amount.Type))
+		b = append(b, `,"value":`...)
+		b = appendString(b, t.Amount.Value)
+		b = append(b, `,"currency":`...)
+		b = appendString(b, t.Amount.Currency)
+		b = append(b, "}}"...)
+	}
+	if len(changeset) > 0 {
+		b = append(b, `,"changeset":`...)
+		b = appendChangeset(e, b, changeset)
+	}
+	if p != nil {
+		b = append(b, `,"product":{"id":`...)
+		b = appendString(b, p.ID)
+		b = append(b, '}')
+	}
+	return b
+}
+
+func appendParams(b []byte, p *Params) []byte {
+	b = append(b, '{')
+	first := true
+	b = appendOptionalString(b, &first, "email", p.Email)
+	b = appendOptionalString(b, &first, "phone", p.Phone)
+	b = appendOptionalString(b, &first, "username", p.Username)
+	if p.Address != nil {
+		b = appendKey(b, &first, "address")
+		b = appendAddress(b, p.Address)
+	}
+	return append(b, '}')
+}
+
+func appendUser(e *encoder, b []byte, u *castleAPIUser) []byte {
+	b = append(b, `{"id":`...)
+	b = appendString(b, u.ID)
+	first := false
+	b = appendOptionalString(b, &first, "email", u.Email)
+	b = appendOptionalString(b, &first, "phone", u.Phone)
+	b = appendOptionalString(b, &first, "name", u.Name)
+	if u.Address != nil {
+		b = appendKey(b, &first, "address")
+		b = appendAddress(b, u.Address)
+	}
+	b = appendOptionalString(b, &first, "registered_at", u.RegisteredAt)
+	if len(u.Traits) > 0 {
+		b = appendKey(b, &first, "traits")
+		b = appendAnyMap(e, b, u.Traits)
+	}
+	return append(b, '}')
+}
+
+func appendAddress(b []byte, a *Address) []byte {
+	b = append(b, '{')
+	first := true
+	b = appendOptionalString(b, &first, "line1", a.Street)
+	b = appendOptionalString(b, &first, "city", a.City)
+	b = appendOptionalString(b, &first, "postal_code", a.Postcode)
+	b = appendOptionalString(b, &first, "region_code", a.Region)
+	b = appendOptionalString(b, &first, "country_code", a.Country)
+	return append(b, '}')
+}
+
+func appendContext(e *encoder, b []byte, c *Context) []byte {
+	if c == nil {
+		return append(b, "null"...)
+	}
+	b = append(b, `{"ip":`...)
+	b = appendString(b, c.IP)
+	b = append(b, `,"headers":`...)
+	b = appendStringMap(e, b, c.Headers)
+	b = append(b, `,"request_token":`...)
+	b = appendString(b, c.RequestToken)
+	return append(b, '}')
+}
+
+func appendChangeset(e *encoder, b []byte, m map[string]Change) []byte {
+	keys, start := sortedKeys(e, m)
+	b = append(b, '{')
+	for i, k := range keys {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		c := m[k]
+		b = appendString(b, k)
+		b = append(b, ":{"...)
+		first := true
+		b = appendOptionalString(b, &first, "from", c.From)
+		b = appendOptionalString(b, &first, "to", c.To)
+		if c.Changed {
+			b = appendKey(b, &first, "changed")
+			b = append(b, "true"...)
+		}
+		b = append(b, '}')
+	}
+	e.keys = e.keys[:start]
+	return append(b, '}')
+}
+
+func appendStringMap(e *encoder, b []byte, m map[string]string) []byte {
+	if m == nil {
+		return append(b, "null"...)
+	}
+	keys, start := sortedKeys(e, m)
+	b = append(b, '{')
+	for i, k := range keys {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendString(b, k)
+		b = append(b, ':')
+		b = appendString(b, m[k])
+	}
+	e.keys = e.keys[:start]
+	return append(b, '}')
+}
+
+func appendAnyMap(e *encoder, b []byte, m map[string]any) []byte {
+	if m == nil {
+		return append(b, "null"...)
+	}
+	keys, start := sortedKeys(e, m)
+	b = append(b, '{')
+	for i, k := range keys {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendString(b, k)
+		b = append(b, ':')
+		b = appendValue(e, b, m[k])
+	}
+	e.keys = e.keys[:start]
+	return append(b, '}')
+}
+
+// sortedKeys appends the keys of m to the encoder's key stack, so nested maps can reuse it.
+// The caller truncates the stack back to start once done.
+func sortedKeys[V any](e *encoder, m map[string]V) ([]string, int) {
+	start := len(e.keys)
+	for k := range m {
+		e.keys = append(e.keys, k)
+	}
+	keys := e.keys[start:]
+	slices.Sort(keys)
+	return keys, start
+}
+
+// appendValue appends the common property and trait values by hand and falls back to encoding/json otherwise.
+func appendValue(e *encoder, b []byte, v any) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(b, "null"...)
+	case string:
+		return appendString(b, v)
+	case bool:
+		return strconv.AppendBool(b, v)
+	case int:
+		return strconv.AppendInt(b, int64(v), 10)
+	case int32:
+		return strconv.AppendInt(b, int64(v), 10)
+	case int64:
+		return strconv.AppendInt(b, v, 10)
+	case uint:
+		return strconv.AppendUint(b, uint64(v), 10)
+	case uint32:
+		return strconv.AppendUint(b, uint64(v), 10)
+	case uint64:
+		return strconv.AppendUint(b, v, 10)
+	case float32:
+		return appendFloat(e, b, float64(v), 32)
+	case float64:
+		return appendFloat(e, b, v, 64)
+	case map[string]any:
+		return appendAnyMap(e, b, v)
+	case Properties:
+		return appendAnyMap(e, b, v)
+	case map[string]string:
+		return appendStringMap(e, b, v)
+	case *Address:
+		if v == nil {
+			return append(b, "null"...)
+		}
+		return appendAddress(b, v)
+	default:
+		vb, err := json.Marshal(v)
+		if err != nil {
+			e.fail(err)
+			return append(b, "null"...)
+		}
+		return append(b, vb...)
+	}
+}
+
+func (e *encoder) fail(err error) {
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+// appendFloat formats floats the way encoding/json does.
+func appendFloat(e *encoder, b []byte, f float64, bits int) []byte {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		e.fail(fmt.Errorf("json: unsupported value: %s", strconv.FormatFloat(f, 'g', -1, bits)))
+		return append(b, "null"...)
+	}
+
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 {
+		if bits == 64 && (abs < 1e-6 || abs >= 1e21) || bits == 32 && (float32(abs) < 1e-6 || float32(abs) >= 1e21) {
+			format = 'e'
+		}
+	}
+	b = strconv.AppendFloat(b, f, format, -1, bits)
+	if format == 'e' {
+		// clean up e-09 to e-9
+		n := len(b)
+		if n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+			b[n-2] = b[n-1]
+			b = b[:n-1]
+		}
+	}
+	return b
+}
+
+func appendTime(b []byte, t time.Time) []byte {
+	b = append(b, '"')
+	b = t.AppendFormat(b, time.RFC3339Nano)
+	return append(b, '"')
+}
+
+// appendKey appends "key": preceded by a comma unless it is the first field of the object.
+func appendKey(b []byte, first *bool, key string) []byte {
+	if !*first {
+		b = append(b, ',')
+	}
+	*first = false
+	b = append(b, '"')
+	b = append(b, key...)
+	return append(b, '"', ':')
+}
+
+func appendOptionalString(b []byte, first *bool, key, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = appendKey(b, first, key)
+	return appendString(b, v)
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendString appends s as a JSON string, escaping it like encoding/json.
+func appendString(b []byte, s string) []byte {
+	b = append(b, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+			b = append(b, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				b = append(b, '\\', c)
+			case '\n':
+				b = append(b, '\\', 'n')
+			case '\r':
+				b = append(b, '\\', 'r')
+			case '\t':
+				b = append(b, '\\', 't')
+			case '\b':
+				b = append(b, '\\', 'b')
+			case '\f':
+				b = append(b, '\\', 'f')
+			default:
+				b = append(b, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, s[start:i]...)
+			b = append(b, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		// U+2028 and U+2029 are valid JSON but break JavaScript
+		if r == '\u2028' || r == '\u2029' {
+			b = append(b, s[start:i]...)
+			b = append(b, '\\', 'u', '2', '0', '2', hexDigits[r&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	b = append(b, s[start:]...)
+	return append(b, '"')
+}
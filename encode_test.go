@@ -0,0 +1,192 @@
+package castle
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testAPIRequests() (*castleFilterAPIRequest, *castleRiskAPIRequest) {
+	castleCtx := &Context{
+		IP: "109.14.23.2",
+		Headers: map[string]string{
+			"User-Agent":             "Mozilla/5.0 <script>&amp;</script>",
+			"X-Castle-Request-Token": "token",
+			"Accept-Language":        "en-GB,en;q=0.9",
+		},
+		RequestToken: "token",
+	}
+	createdAt := time.Date(2024, 5, 6, 7, 8, 9, 123456789, time.UTC)
+	properties := map[string]any{
+		"string":  "quote \" backslash \\ newline \n tab \t backspace \b form feed \f control \x01 invalid \xff separator  ",
+		"bool":    true,
+		"int":     42,
+		"uint64":  uint64(math.MaxUint64),
+		"float":   0.1,
+		"small":   1e-7,
+		"large":   1e21,
+		"float32": float32(0.1),
+		"nil":     nil,
+		"nested":  map[string]any{"b": []string{"x", "y"}, "a": Properties{"c": 1.5}},
+		"strings": map[string]string{"k": "v"},
+		"address": &Address{City: "London", Country: "GB"},
+		"time":    createdAt,
+	}
+	am := &AuthenticationMethod{Type: AuthenticationMethodSocial, Variant: "google"}
+	transaction := &Transaction{ID: "tx-id", Amount: Amount{Type: AmountTypeFiat, Value: "49.99", Currency: "GBP"}}
+	changeset := map[string]Change{
+		"password": {Changed: true},
+		"email":    {From: "old@test.com", To: "new@test.com"},
+	}
+	product := &Product{ID: "product-id"}
+	address := &Address{Street: "1 Road", City: "London", Postcode: "NW1 1AA", Region: "ENG", Country: "GB"}
+
+	filter := &castleFilterAPIRequest{
+		Type:                 EventTypeLogin,
+		Name:                 "name",
+		Status:               EventStatusFailed,
+		RequestToken:         "token",
+		Params:               Params{Email: "user@test.com", Phone: "+447700900000", Username: "user-id", Address: address},
+		MatchingUserID:       "matching-id",
+		Context:              castleCtx,
+		Properties:           properties,
+		AuthenticationMethod: am,
+		Transaction:          transaction,
+		Changeset:            changeset,
+		Product:              product,
+		CreatedAt:            createdAt,
+	}
+	risk := &castleRiskAPIRequest{
+		Type:         EventTypeLogin,
+		Status:       EventStatusSucceeded,
+		RequestToken: "token",
+		User: castleAPIUser{
+			ID:           "user-id",
+			Email:        "user@test.com",
+			Name:         "Jane Doe",
+			Address:      address,
+			RegisteredAt: "2020-01-01T00:00:00Z",
+			Traits:       properties,
+		},
+		Context:              castleCtx,
+		Properties:           properties,
+		AuthenticationMethod: am,
+		Transaction:          transaction,
+		Changeset:            changeset,
+		Product:              product,
+		CreatedAt:            createdAt,
+	}
+	return filter, risk
+}
+
+func TestAppendJSON(t *testing.T) {
+	filter, risk := testAPIRequests()
+
+	tests := map[string]castleAPIRequest{
+		"filter":         filter,
+		"risk":           risk,
+		"minimal filter": &castleFilterAPIRequest{Type: EventTypeLogin, Status: EventStatusAttempted},
+		"minimal risk":   &castleRiskAPIRequest{Type: EventTypeLogin, Status: EventStatusSucceeded, Context: &Context{}},
+	}
+	for name, r := range tests {
+		t.Run(name, func(t *testing.T) {
+			expected, err := json.Marshal(r)
+			require.NoError(t, err)
+
+			e := getEncoder()
+			defer e.release()
+			got := r.appendJSON(e, e.buf)
+			require.NoError(t, e.err)
+			assert.Equal(t, string(expected), string(got))
+		})
+	}
+
+	t.Run("unsupported value", func(t *testing.T) {
+		e := getEncoder()
+		defer e.release()
+		(&castleFilterAPIRequest{Properties: map[string]any{"nan": math.NaN()}}).appendJSON(e, e.buf)
+		assert.EqualError(t, e.err, "json: unsupported value: NaN")
+	})
+}
+
+func TestEncoderBody(t *testing.T) {
+	filter, _ := testAPIRequests()
+
+	e := getEncoder()
+	e.buf = filter.appendJSON(e, e.buf)
+	expected := string(e.buf)
+
+	// every attempt reads the whole request, whatever the order the bodies are closed in
+	first, retry := e.body(), e.body()
+	for _, body := range []io.ReadCloser{first, retry} {
+		got, err := io.ReadAll(body)
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(got))
+	}
+
+	e.release()
+	require.NoError(t, retry.Close())
+	assert.Equal(t, int32(1), e.refs.Load())
+	require.NoError(t, first.Close())
+	assert.Zero(t, e.refs.Load())
+
+	// the encoder is reused by the next request, a late Close or Read of the old bodies must not touch it
+	e = getEncoder()
+	e.buf = append(e.buf, "next request"...)
+	require.NoError(t, first.Close())
+	assert.Equal(t, int32(1), e.refs.Load())
+	_, err := first.Read(make([]byte, 8))
+	assert.ErrorIs(t, err, http.ErrBodyReadAfterClose)
+}
+
+func TestAppendJSON_Allocs(t *testing.T) {
+	filter, risk := testAPIRequests()
+	// encoding/json is only used for the time.Time and []string values, the requests share the properties
+	delete(filter.Properties, "time")
+	delete(filter.Properties, "nested")
+
+	for name, r := range map[string]castleAPIRequest{"filter": filter, "risk": risk} {
+		t.Run(name, func(t *testing.T) {
+			// the pool may drop encoders, e.g. with the race detector, so a single one is reused instead
+			e := getEncoder()
+			allocs := testing.AllocsPerRun(100, func() {
+				e.buf = r.appendJSON(e, e.buf[:0])
+			})
+			assert.Zero(t, allocs)
+		})
+	}
+}
+
+func BenchmarkEncodeRequest(b *testing.B) {
+	filter, risk := testAPIRequests()
+	delete(filter.Properties, "time")
+	delete(filter.Properties, "nested")
+
+	for name, r := range map[string]castleAPIRequest{"filter": filter, "risk": risk} {
+		b.Run(name+"/appendJSON", func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				e := getEncoder()
+				e.buf = r.appendJSON(e, e.buf)
+				e.release()
+			}
+		})
+
+		b.Run(name+"/encoding-json", func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				buf := new(bytes.Buffer)
+				if err := json.NewEncoder(buf).Encode(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package castle
+
+import (
+	"context"
+	"net/http"
+)
+
+// Filterer is implemented by Castle and MultiTenant.
+type Filterer interface {
+	Filter(ctx context.Context, req *Request) (RecommendedAction, error)
+}
+
+// RequestMapper maps an incoming request to the Castle request to filter, i.e. its Event and User.
+// The Context is filled in by the middleware when left nil.
+type RequestMapper func(r *http.Request) (*Request, error)
+
+var decisionCtxKey = contextKey("castle_decision")
+
+// DecisionToCtx adds the recommended action to the context.Context.
+func DecisionToCtx(ctx context.Context, action RecommendedAction) context.Context {
+	return context.WithValue(ctx, decisionCtxKey, action)
+}
+
+// DecisionFromCtx returns the recommended action from the context.Context, if there is one.
+func DecisionFromCtx(ctx context.Context) (RecommendedAction, bool) {
+	action, ok := ctx.Value(decisionCtxKey).(RecommendedAction)
+	return action, ok
+}
+
+// WithDenyHandler sets the handler serving denied requests in EnforcementMiddleware.
+// It defaults to a 403 JSON response.
+func WithDenyHandler(h http.Handler) MiddlewareOpt {
+	return func(o *middlewareOpts) {
+		o.denyHandler = h
+	}
+}
+
+// WithChallengeHandler sets the handler serving challenged requests in EnforcementMiddleware,
+// e.g. ChallengeRedirect. It defaults to a 401 JSON response.
+func WithChallengeHandler(h http.Handler) MiddlewareOpt {
+	return func(o *middlewareOpts) {
+		o.challengeHandler = h
+	}
+}
+
+// WithErrorHandler sets the function responding when the request cannot be mapped or filtered.
+// By default EnforcementMiddleware acts on the failure action of the client, see WithFailureAction, and
+// otherwise fails open and calls the next handler without a decision.
+func WithErrorHandler(fn func(w http.ResponseWriter, r *http.Request, err error)) MiddlewareOpt {
+	return func(o *middlewareOpts) {
+		o.errorHandler = fn
+	}
+}
+
+// ChallengeRedirect returns a challenge handler redirecting to url, e.g. an MFA page.
+func ChallengeRedirect(url string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, url, http.StatusSeeOther)
+	})
+}
+
+// ChallengeHeader returns a challenge handler responding 401 with the given header set.
+func ChallengeHeader(name, value string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set(name, value)
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+}
+
+var (
+	defaultDenyHandler      = jsonErrorHandler(http.StatusForbidden, `{"error":"forbidden"}`)
+	defaultChallengeHandler = jsonErrorHandler(http.StatusUnauthorized, `{"error":"challenge_required"}`)
+)
+
+func jsonErrorHandler(status int, body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body)) // nolint: errcheck
+	})
+}
+
+// EnforcementMiddleware calls Filter for matching requests and acts on the recommended action:
+// denied and challenged requests are served by the deny and challenge handlers, others are passed
+// to the next handler with the decision available through DecisionFromCtx.
+//
+// It accepts the same options as Middleware. Unlike Middleware, requests without a request token are
+// filtered too, unless WithIgnoreEmpty(true) is passed.
+func EnforcementMiddleware(c Filterer, mapper RequestMapper, opts ...MiddlewareOpt) func(next http.Handler) http.Handler {
+	options := &middlewareOpts{
+		methods:          []string{http.MethodPost},
+		denyHandler:      defaultDenyHandler,
+		challengeHandler: defaultChallengeHandler,
+	}
+
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !options.matches(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			castleCtx := fromHTTPRequest(r, options.headerPolicy, options.clientIP, options.tokenExtractor)
+			if options.ignoreEmpty && castleCtx.RequestToken == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			r = r.WithContext(ToCtx(r.Context(), castleCtx))
+
+			action, err := filterHTTPRequest(c, mapper, r, castleCtx)
+			if err != nil {
+				if options.errorHandler != nil {
+					options.errorHandler(w, r, err)
+					return
+				}
+				// the failure action of the client, if any, applies like any other decision
+				if action == RecommendedActionNone {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			r = r.WithContext(DecisionToCtx(r.Context(), action))
+			switch action {
+			case RecommendedActionDeny:
+				options.denyHandler.ServeHTTP(w, r)
+			case RecommendedActionChallenge:
+				options.challengeHandler.ServeHTTP(w, r)
+			case RecommendedActionAllow, RecommendedActionNone:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+func filterHTTPRequest(c Filterer, mapper RequestMapper, r *http.Request, castleCtx *Context) (RecommendedAction, error) {
+	req, err := mapper(r)
+	if err != nil {
+		return RecommendedActionNone, err
+	}
+	if req != nil && req.Context == nil {
+		req.Context = castleCtx
+	}
+	return c.Filter(r.Context(), req)
+}
@@ -0,0 +1,202 @@
+package castle_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/utilitywarehouse/castle-go"
+)
+
+func TestEnforcementMiddleware(t *testing.T) {
+	newClient := func(t *testing.T, action string) *castle.Castle {
+		t.Helper()
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			_, err := w.Write([]byte(`{"policy": {"action": "` + action + `"}}`))
+			require.NoError(t, err)
+		}))
+		t.Cleanup(ts.Close)
+
+		cstl, err := castle.New("secret-string", castle.WithEndpoints(ts.URL, ts.URL))
+		require.NoError(t, err)
+		return cstl
+	}
+
+	mapper := func(r *http.Request) (*castle.Request, error) {
+		if r.URL.Query().Has("fail") {
+			return nil, errors.New("mapping failed")
+		}
+		return &castle.Request{
+			Event: castle.Event{EventType: castle.EventTypeLogin, EventStatus: castle.EventStatusAttempted},
+			User:  castle.User{Email: r.FormValue("email")},
+		}, nil
+	}
+
+	tests := map[string]struct {
+		action         string
+		opts           []castle.MiddlewareOpt
+		path           string
+		expectedStatus int
+		expectedHeader http.Header
+		expectedNext   bool
+		expectedAction castle.RecommendedAction
+	}{
+		"allow": {
+			action:         "allow",
+			path:           "/login",
+			expectedStatus: http.StatusOK,
+			expectedNext:   true,
+			expectedAction: castle.RecommendedActionAllow,
+		},
+		"deny": {
+			action:         "deny",
+			path:           "/login",
+			expectedStatus: http.StatusForbidden,
+			expectedHeader: http.Header{"Content-Type": {"application/json"}},
+		},
+		"challenge": {
+			action:         "challenge",
+			path:           "/login",
+			expectedStatus: http.StatusUnauthorized,
+			expectedHeader: http.Header{"Content-Type": {"application/json"}},
+		},
+		"challenge redirect": {
+			action:         "challenge",
+			opts:           []castle.MiddlewareOpt{castle.WithChallengeHandler(castle.ChallengeRedirect("/mfa"))},
+			path:           "/login",
+			expectedStatus: http.StatusSeeOther,
+			expectedHeader: http.Header{"Location": {"/mfa"}},
+		},
+		"challenge header": {
+			action:         "challenge",
+			opts:           []castle.MiddlewareOpt{castle.WithChallengeHandler(castle.ChallengeHeader("X-Challenge", "mfa"))},
+			path:           "/login",
+			expectedStatus: http.StatusUnauthorized,
+			expectedHeader: http.Header{"X-Challenge": {"mfa"}},
+		},
+		"custom deny handler": {
+			action: "deny",
+			opts: []castle.MiddlewareOpt{castle.WithDenyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				action, _ := castle.DecisionFromCtx(r.Context())
+				w.Header().Set("X-Decision", string(action))
+				w.WriteHeader(http.StatusTeapot)
+			}))},
+			path:           "/login",
+			expectedStatus: http.StatusTeapot,
+			expectedHeader: http.Header{"X-Decision": {"deny"}},
+		},
+		"not matching route": {
+			action:         "deny",
+			opts:           []castle.MiddlewareOpt{castle.WithPathFilter("/register")},
+			path:           "/login",
+			expectedStatus: http.StatusOK,
+			expectedNext:   true,
+		},
+		"fails open on error": {
+			action:         "deny",
+			path:           "/login?fail",
+			expectedStatus: http.StatusOK,
+			expectedNext:   true,
+		},
+		"error handler": {
+			action: "deny",
+			opts: []castle.MiddlewareOpt{castle.WithErrorHandler(func(w http.ResponseWriter, _ *http.Request, err error) {
+				assert.EqualError(t, err, "mapping failed")
+				w.WriteHeader(http.StatusServiceUnavailable)
+			})},
+			path:           "/login?fail",
+			expectedStatus: http.StatusServiceUnavailable,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var (
+				nextCalled bool
+				gotAction  castle.RecommendedAction
+			)
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nextCalled = true
+				gotAction, _ = castle.DecisionFromCtx(r.Context())
+				w.WriteHeader(http.StatusOK)
+			})
+
+			handler := castle.EnforcementMiddleware(newClient(t, test.action), mapper, test.opts...)(next)
+
+			req := httptest.NewRequest(http.MethodPost, "https://example.com"+test.path, nil)
+			req.Header.Set("X-Castle-Request-Token", "token")
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, test.expectedStatus, rec.Code)
+			for k := range test.expectedHeader {
+				assert.Equal(t, test.expectedHeader.Get(k), rec.Header().Get(k))
+			}
+			assert.Equal(t, test.expectedNext, nextCalled)
+			assert.Equal(t, test.expectedAction, gotAction)
+		})
+	}
+}
+
+func TestEnforcementMiddleware_FailureAction(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(ts.Close)
+
+	mapper := func(*http.Request) (*castle.Request, error) {
+		return &castle.Request{Event: castle.Event{EventType: castle.EventTypeLogin, EventStatus: castle.EventStatusAttempted}}, nil
+	}
+
+	tests := map[string]struct {
+		failureAction  castle.RecommendedAction
+		expectedStatus int
+		expectedNext   bool
+		expectedAction castle.RecommendedAction
+	}{
+		"fail closed": {
+			failureAction:  castle.RecommendedActionDeny,
+			expectedStatus: http.StatusForbidden,
+		},
+		"fail open": {
+			failureAction:  castle.RecommendedActionAllow,
+			expectedStatus: http.StatusOK,
+			expectedNext:   true,
+			expectedAction: castle.RecommendedActionAllow,
+		},
+		"no failure action": {
+			expectedStatus: http.StatusOK,
+			expectedNext:   true,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cstl, err := castle.New("secret-string", castle.WithEndpoints(ts.URL, ts.URL), castle.WithFailureAction(test.failureAction))
+			require.NoError(t, err)
+
+			var (
+				nextCalled bool
+				gotAction  castle.RecommendedAction
+			)
+			handler := castle.EnforcementMiddleware(cstl, mapper)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nextCalled = true
+				gotAction, _ = castle.DecisionFromCtx(r.Context())
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest(http.MethodPost, "https://example.com/login", nil)
+			req.Header.Set("X-Castle-Request-Token", "token")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, test.expectedStatus, rec.Code)
+			assert.Equal(t, test.expectedNext, nextCalled)
+			assert.Equal(t, test.expectedAction, gotAction)
+		})
+	}
+}
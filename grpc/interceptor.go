@@ -0,0 +1,182 @@
+package grpc
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"github.com/utilitywarehouse/castle-go"
+)
+
+// contextMetadataKey carries the encoded Castle context between services.
+var contextMetadataKey = strings.ToLower(castle.PropagationHeader)
+
+type options struct {
+	headerPolicy *castle.HeaderPolicy
+	clientIP     func(*http.Request) string
+	ignoreEmpty  bool
+	propagator   *castle.Propagator
+}
+
+type Opt func(*options)
+
+// WithHeaderPolicy sets the policy deciding which metadata is forwarded to Castle, castle.DefaultHeaderPolicy is used otherwise.
+func WithHeaderPolicy(p *castle.HeaderPolicy) Opt {
+	return func(o *options) {
+		o.headerPolicy = p
+	}
+}
+
+// WithClientIP sets the function extracting the client IP, castle.DefaultClientIP is used otherwise.
+// Metadata is exposed as request headers and the peer address as the remote address, so the IPFromRequest
+// method of a http.IPResolver only believes forwarding metadata set by trusted proxies.
+func WithClientIP(fn func(*http.Request) string) Opt {
+	return func(o *options) {
+		o.clientIP = fn
+	}
+}
+
+// WithIgnoreEmpty skips storing the Castle context when it has no request token, it defaults to true.
+func WithIgnoreEmpty(ignore bool) Opt {
+	return func(o *options) {
+		o.ignoreEmpty = ignore
+	}
+}
+
+// WithPropagator sets the propagator encoding and decoding the Castle context passed between services.
+// Contexts are neither propagated nor decoded without it, and server interceptors ignore them unless
+// the propagator has a signing key: otherwise any caller could choose the IP and headers Castle sees.
+// Client and server interceptors must use the same key.
+func WithPropagator(p *castle.Propagator) Opt {
+	return func(o *options) {
+		o.propagator = p
+	}
+}
+
+func newOptions(opts []Opt) *options {
+	o := &options{
+		ignoreEmpty: true,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// FromIncomingContext builds the Castle context from incoming gRPC metadata.
+//
+// A valid signed context propagated by the client interceptors of an upstream service takes precedence,
+// see WithPropagator.
+// Otherwise metadata is treated like HTTP headers, i.e. the request token, client IP and forwarded
+// headers follow the same rules as castle.FromHTTPRequest, with the peer address as the remote address.
+func FromIncomingContext(ctx context.Context, opts ...Opt) *castle.Context {
+	return fromIncomingContext(ctx, newOptions(opts))
+}
+
+func fromIncomingContext(ctx context.Context, o *options) *castle.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	if vs := md.Get(contextMetadataKey); len(vs) > 0 && o.propagator != nil && o.propagator.Signed() {
+		if castleCtx, _, err := o.propagator.Decode(vs[0]); err == nil {
+			return castleCtx
+		}
+	}
+
+	r := &http.Request{
+		URL:    &url.URL{},
+		Header: headerFromMetadata(md),
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		r.RemoteAddr = p.Addr.String()
+	}
+	castleCtx := castle.FromHTTPRequestWithPolicy(r, o.headerPolicy)
+	if o.clientIP != nil {
+		castleCtx.IP = o.clientIP(r)
+	}
+	return castleCtx
+}
+
+// headerFromMetadata converts metadata to HTTP headers, leaving out pseudo headers, gRPC internals, binary values
+// and the propagated context.
+func headerFromMetadata(md metadata.MD) http.Header {
+	h := make(http.Header, len(md))
+	for k, vs := range md {
+		if strings.HasPrefix(k, ":") || strings.HasPrefix(k, "grpc-") || strings.HasSuffix(k, "-bin") || k == contextMetadataKey {
+			continue
+		}
+		for _, v := range vs {
+			h.Add(k, v)
+		}
+	}
+	return h
+}
+
+func toCtx(ctx context.Context, o *options) context.Context {
+	castleCtx := fromIncomingContext(ctx, o)
+	if o.ignoreEmpty && castleCtx.RequestToken == "" {
+		return ctx
+	}
+	return castle.ToCtx(ctx, castleCtx)
+}
+
+// UnaryServerInterceptor stores the Castle context built from incoming metadata with castle.ToCtx.
+func UnaryServerInterceptor(opts ...Opt) grpc.UnaryServerInterceptor {
+	o := newOptions(opts)
+	return func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		return handler(toCtx(ctx, o), req)
+	}
+}
+
+// StreamServerInterceptor stores the Castle context built from incoming metadata with castle.ToCtx.
+func StreamServerInterceptor(opts ...Opt) grpc.StreamServerInterceptor {
+	o := newOptions(opts)
+	return func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &serverStream{ServerStream: ss, ctx: toCtx(ss.Context(), o)})
+	}
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// outgoingContext appends the Castle context found in ctx, if any, to the outgoing metadata.
+// A context that cannot be encoded, e.g. because it is too large, is not propagated.
+func outgoingContext(ctx context.Context, o *options) context.Context {
+	castleCtx := castle.FromCtx(ctx)
+	if castleCtx == nil || o.propagator == nil {
+		return ctx
+	}
+	encoded, err := o.propagator.Encode(castleCtx)
+	if err != nil {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, contextMetadataKey, encoded)
+}
+
+// UnaryClientInterceptor propagates the Castle context to the called service.
+// Only the WithPropagator option applies.
+func UnaryClientInterceptor(opts ...Opt) grpc.UnaryClientInterceptor {
+	o := newOptions(opts)
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(outgoingContext(ctx, o), method, req, reply, cc, opts...)
+	}
+}
+
+// StreamClientInterceptor propagates the Castle context to the called service.
+// Only the WithPropagator option applies.
+func StreamClientInterceptor(opts ...Opt) grpc.StreamClientInterceptor {
+	o := newOptions(opts)
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(outgoingContext(ctx, o), desc, cc, method, opts...)
+	}
+}
@@ -0,0 +1,230 @@
+package grpc_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"github.com/utilitywarehouse/castle-go"
+	grpc_internal "github.com/utilitywarehouse/castle-go/grpc"
+	http_internal "github.com/utilitywarehouse/castle-go/http"
+)
+
+func incomingContext(md metadata.MD) context.Context {
+	ctx := metadata.NewIncomingContext(context.Background(), md)
+	return peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}})
+}
+
+func TestFromIncomingContext(t *testing.T) {
+	resolver, err := http_internal.NewIPResolver([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	untrusted, err := http_internal.NewIPResolver([]string{"192.168.0.0/16"})
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		md       metadata.MD
+		opts     []grpc_internal.Opt
+		expected *castle.Context
+	}{
+		"metadata": {
+			md: metadata.Pairs(
+				"x-castle-request-token", "token",
+				"x-forwarded-for", "109.14.23.2, 10.0.0.2",
+				"user-agent", "some-agent",
+				"authorization", "Bearer secret",
+				"grpc-timeout", "1S",
+				"trace-bin", "binary",
+			),
+			expected: &castle.Context{
+				IP: "109.14.23.2",
+				Headers: map[string]string{
+					"X-Castle-Request-Token": "token",
+					"X-Forwarded-For":        "109.14.23.2, 10.0.0.2",
+					"User-Agent":             "some-agent",
+				},
+				RequestToken: "token",
+			},
+		},
+		"peer address": {
+			md: metadata.Pairs("castle-token", "token"),
+			expected: &castle.Context{
+				IP:           "10.0.0.1",
+				Headers:      map[string]string{"Castle-Token": "token"},
+				RequestToken: "token",
+			},
+		},
+		"header policy": {
+			md: metadata.Pairs(
+				"x-castle-request-token", "token",
+				"x-internal", "internal",
+			),
+			opts: []grpc_internal.Opt{grpc_internal.WithHeaderPolicy(&castle.HeaderPolicy{Deny: []string{"X-Internal"}})},
+			expected: &castle.Context{
+				IP:           "10.0.0.1",
+				Headers:      map[string]string{"X-Castle-Request-Token": "token"},
+				RequestToken: "token",
+			},
+		},
+		"client IP resolver": {
+			md: metadata.Pairs(
+				"castle-token", "token",
+				"x-forwarded-for", "6.6.6.6, 109.14.23.2",
+			),
+			opts: []grpc_internal.Opt{grpc_internal.WithClientIP(resolver.IPFromRequest)},
+			expected: &castle.Context{
+				IP:           "109.14.23.2",
+				Headers:      map[string]string{"Castle-Token": "token", "X-Forwarded-For": "6.6.6.6, 109.14.23.2"},
+				RequestToken: "token",
+			},
+		},
+		"client IP resolver with untrusted peer": {
+			md: metadata.Pairs(
+				"castle-token", "token",
+				"x-forwarded-for", "109.14.23.2",
+			),
+			opts: []grpc_internal.Opt{grpc_internal.WithClientIP(untrusted.IPFromRequest)},
+			expected: &castle.Context{
+				IP:           "10.0.0.1",
+				Headers:      map[string]string{"Castle-Token": "token", "X-Forwarded-For": "109.14.23.2"},
+				RequestToken: "token",
+			},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := grpc_internal.FromIncomingContext(incomingContext(test.md), test.opts...)
+			assert.Equal(t, test.expected, got)
+		})
+	}
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	t.Run("ctx is set", func(t *testing.T) {
+		ctx := incomingContext(metadata.Pairs("x-castle-request-token", "token"))
+
+		_, err := grpc_internal.UnaryServerInterceptor()(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, _ any) (any, error) {
+			castleCtx := castle.FromCtx(ctx)
+			require.NotNil(t, castleCtx)
+			assert.Equal(t, "token", castleCtx.RequestToken)
+			return nil, nil
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("ctx is not set", func(t *testing.T) {
+		ctx := incomingContext(metadata.Pairs())
+
+		_, err := grpc_internal.UnaryServerInterceptor()(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, _ any) (any, error) {
+			assert.Nil(t, castle.FromCtx(ctx))
+			return nil, nil
+		})
+		require.NoError(t, err)
+	})
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func TestStreamServerInterceptor(t *testing.T) {
+	ss := &serverStream{ctx: incomingContext(metadata.Pairs("x-castle-request-token", "token"))}
+
+	err := grpc_internal.StreamServerInterceptor()(nil, ss, &grpc.StreamServerInfo{}, func(_ any, stream grpc.ServerStream) error {
+		castleCtx := castle.FromCtx(stream.Context())
+		require.NotNil(t, castleCtx)
+		assert.Equal(t, "token", castleCtx.RequestToken)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestClientInterceptors(t *testing.T) {
+	original := &castle.Context{
+		IP:           "109.14.23.2",
+		Headers:      map[string]string{"User-Agent": "browser"},
+		RequestToken: "token",
+	}
+	ctx := castle.ToCtx(context.Background(), original)
+	signed := grpc_internal.WithPropagator(castle.NewPropagator(castle.WithSigningKey([]byte("key"))))
+
+	// the metadata sent by the client is received by the next service
+	propagated := func(t *testing.T, ctx context.Context) *castle.Context {
+		t.Helper()
+		md, ok := metadata.FromOutgoingContext(ctx)
+		require.True(t, ok)
+
+		var got *castle.Context
+		_, err := grpc_internal.UnaryServerInterceptor(signed)(incomingContext(md), nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, _ any) (any, error) {
+			got = castle.FromCtx(ctx)
+			return nil, nil
+		})
+		require.NoError(t, err)
+		return got
+	}
+
+	t.Run("unary", func(t *testing.T) {
+		err := grpc_internal.UnaryClientInterceptor(signed)(ctx, "/svc/Method", nil, nil, nil, func(ctx context.Context, _ string, _, _ any, _ *grpc.ClientConn, _ ...grpc.CallOption) error {
+			assert.Equal(t, original, propagated(t, ctx))
+			return nil
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		_, err := grpc_internal.StreamClientInterceptor(signed)(ctx, &grpc.StreamDesc{}, nil, "/svc/Method", func(ctx context.Context, _ *grpc.StreamDesc, _ *grpc.ClientConn, _ string, _ ...grpc.CallOption) (grpc.ClientStream, error) {
+			assert.Equal(t, original, propagated(t, ctx))
+			return nil, nil
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("not propagated without propagator", func(t *testing.T) {
+		err := grpc_internal.UnaryClientInterceptor()(ctx, "/svc/Method", nil, nil, nil, func(ctx context.Context, _ string, _, _ any, _ *grpc.ClientConn, _ ...grpc.CallOption) error {
+			md, _ := metadata.FromOutgoingContext(ctx)
+			assert.Empty(t, md.Get("x-castle-context"))
+			return nil
+		})
+		require.NoError(t, err)
+	})
+}
+
+func TestSignedPropagation(t *testing.T) {
+	signed := grpc_internal.WithPropagator(castle.NewPropagator(castle.WithSigningKey([]byte("key"))))
+
+	encoded, err := castle.NewPropagator().Encode(&castle.Context{IP: "6.6.6.6", RequestToken: "forged"})
+	require.NoError(t, err)
+
+	// an unsigned context is ignored and the context is built from metadata instead
+	ctx := incomingContext(metadata.Pairs(
+		"x-castle-context", encoded,
+		"x-castle-request-token", "token",
+	))
+	fromMetadata := &castle.Context{
+		IP:           "10.0.0.1",
+		Headers:      map[string]string{"X-Castle-Request-Token": "token"},
+		RequestToken: "token",
+	}
+
+	t.Run("signing propagator", func(t *testing.T) {
+		assert.Equal(t, fromMetadata, grpc_internal.FromIncomingContext(ctx, signed))
+	})
+
+	t.Run("default options", func(t *testing.T) {
+		assert.Equal(t, fromMetadata, grpc_internal.FromIncomingContext(ctx))
+	})
+
+	t.Run("unsigned propagator", func(t *testing.T) {
+		assert.Equal(t, fromMetadata, grpc_internal.FromIncomingContext(ctx, grpc_internal.WithPropagator(castle.NewPropagator())))
+	})
+}
@@ -0,0 +1,125 @@
+package castle
+
+import (
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// CastleRecommendedHeaders is the set of headers Castle recommends forwarding, for use with HeaderPolicy.Allow.
+//
+// See https://docs.castle.io/docs/context-object
+var CastleRecommendedHeaders = []string{
+	"Accept",
+	"Accept-Charset",
+	"Accept-Datetime",
+	"Accept-Encoding",
+	"Accept-Language",
+	"Cache-Control",
+	"Connection",
+	"Content-Length",
+	"Content-Type",
+	"Dnt",
+	"Host",
+	"Origin",
+	"Pragma",
+	"Referer",
+	"Sec-Ch-Ua",
+	"Sec-Ch-Ua-Mobile",
+	"Sec-Ch-Ua-Platform",
+	"Sec-Fetch-Dest",
+	"Sec-Fetch-Mode",
+	"Sec-Fetch-Site",
+	"Sec-Fetch-User",
+	"Te",
+	"Upgrade-Insecure-Requests",
+	"User-Agent",
+	"X-Castle-Request-Token",
+	"X-Requested-With",
+}
+
+// credentialHeaders are never forwarded, whatever the policy.
+var credentialHeaders = []string{"authorization", "cookie", "proxy-authorization"}
+
+// bearerOrJWT matches values carrying a bearer token or a JWT, whose header and payload are base64url JSON objects.
+var bearerOrJWT = regexp.MustCompile(`(?i)^\s*bearer\s|eyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.`)
+
+// ScrubCredentials is a HeaderPolicy.Scrub dropping values that look like a bearer token or a JWT,
+// whatever the header carrying them.
+func ScrubCredentials(_, value string) string {
+	if bearerOrJWT.MatchString(value) {
+		return ""
+	}
+	return value
+}
+
+// HeaderPolicy decides which request headers are forwarded to Castle.
+// Header names are matched case-insensitively, patterns are matched against the lower-cased name.
+// Authorization, Cookie and Proxy-Authorization are never forwarded, whatever the policy.
+type HeaderPolicy struct {
+	// Deny lists headers that are never forwarded, it takes precedence over Allow.
+	Deny         []string
+	DenyPatterns []*regexp.Regexp
+	// Allow switches the policy to allowlist mode when it, or AllowPatterns, is not empty:
+	// only matching headers are forwarded.
+	Allow         []string
+	AllowPatterns []*regexp.Regexp
+	// Scrub is called for every forwarded header and returns the value to send.
+	// Returning an empty string drops the header.
+	Scrub func(name, value string) string
+}
+
+// DefaultHeaderPolicy is used by FromHTTPRequest and Middleware unless another policy is passed.
+// It can be replaced at start up to enforce a policy across a service.
+var DefaultHeaderPolicy = &HeaderPolicy{
+	Deny: []string{
+		"Authorization",
+		"Cookie",
+		"Proxy-Authorization",
+		"X-Api-Key",
+		"X-Internal-Auth",
+		// service mesh identity, e.g. Envoy/Istio client certificates
+		"X-Forwarded-Client-Cert",
+	},
+	// e.g. X-Jwt-Assertion or X-Amzn-Oidc-Data set by gateways after authenticating the caller
+	DenyPatterns: []*regexp.Regexp{regexp.MustCompile(`(^|-)(jwt|oidc)(-|$)`)},
+	Scrub:        ScrubCredentials,
+}
+
+// Filter returns the headers allowed by the policy, with multiple values joined.
+func (p *HeaderPolicy) Filter(hs http.Header) map[string]string {
+	castleHeaders := make(map[string]string)
+	for key, value := range hs {
+		if !p.allowed(key) {
+			continue
+		}
+		// View: https://www.w3.org/Protocols/rfc2616/rfc2616-sec4.html
+		v := strings.Join(value, ", ")
+		if p.Scrub != nil {
+			if v = p.Scrub(key, v); v == "" {
+				continue
+			}
+		}
+		castleHeaders[key] = v
+	}
+	return castleHeaders
+}
+
+func (p *HeaderPolicy) allowed(name string) bool {
+	lower := strings.ToLower(name)
+	if slices.Contains(credentialHeaders, lower) || matchHeader(lower, p.Deny, p.DenyPatterns) {
+		return false
+	}
+	if len(p.Allow) == 0 && len(p.AllowPatterns) == 0 {
+		return true
+	}
+	return matchHeader(lower, p.Allow, p.AllowPatterns)
+}
+
+func matchHeader(lower string, names []string, patterns []*regexp.Regexp) bool {
+	if slices.ContainsFunc(names, func(n string) bool { return strings.EqualFold(n, lower) }) {
+		return true
+	}
+	return slices.ContainsFunc(patterns, func(re *regexp.Regexp) bool { return re.MatchString(lower) })
+}
@@ -0,0 +1,6 @@
+package http
+
+// ResetPrivateRanges removes the ranges added with AddPrivateRanges.
+func ResetPrivateRanges() {
+	addedCidrs.Store(nil)
+}
@@ -0,0 +1,71 @@
+package http
+
+import (
+	"net/http"
+	"strings"
+)
+
+// forwardedHops returns the for= node of every element of all Forwarded headers, in order.
+// Ports, brackets and quotes are removed. Elements without a for= parameter yield an empty node.
+//
+// See https://www.rfc-editor.org/rfc/rfc7239
+func forwardedHops(h http.Header) []string {
+	var hops []string
+	for _, v := range h.Values("Forwarded") {
+		for _, elem := range splitQuoted(v, ',') {
+			var node string
+			for _, pair := range splitQuoted(elem, ';') {
+				key, value, ok := strings.Cut(pair, "=")
+				if ok && strings.EqualFold(strings.TrimSpace(key), "for") {
+					node = forwardedNode(value)
+					break
+				}
+			}
+			hops = append(hops, node)
+		}
+	}
+	return hops
+}
+
+// forwardedNode strips quotes, IPv6 brackets and the port from a node, e.g. "[2001:db8::17]:4711".
+// Obfuscated identifiers and "unknown" are returned as is and fail to parse as an address later.
+func forwardedNode(node string) string {
+	node = strings.TrimSpace(node)
+	if len(node) >= 2 && node[0] == '"' && node[len(node)-1] == '"' {
+		node = strings.ReplaceAll(node[1:len(node)-1], `\`, "")
+	}
+	if strings.HasPrefix(node, "[") {
+		if end := strings.IndexByte(node, ']'); end > 0 {
+			return node[1:end]
+		}
+		return node
+	}
+	// a single colon can only be an IPv4 address or identifier with a port
+	if strings.Count(node, ":") == 1 {
+		node, _, _ = strings.Cut(node, ":")
+	}
+	return node
+}
+
+// splitQuoted splits s on sep, ignoring separators within quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	inQuotes := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			inQuotes = !inQuotes
+		case '\\':
+			if inQuotes {
+				i++ // skip the escaped character
+			}
+		case sep:
+			if !inQuotes {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
@@ -1,35 +1,97 @@
 package http
 
 import (
-	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
+	"sync/atomic"
 )
 
-var cidrs []*net.IPNet
+var cidrs []netip.Prefix
+
+// addedCidrs holds the ranges added with AddPrivateRanges, swapped as a whole so IPFromRequest never locks.
+var addedCidrs atomic.Pointer[[]netip.Prefix]
 
 func init() {
 	maxCidrBlocks := []string{
-		"127.0.0.1/8",    // localhost
-		"10.0.0.0/8",     // 24-bit block
-		"172.16.0.0/12",  // 20-bit block
-		"192.168.0.0/16", // 16-bit block
-		"169.254.0.0/16", // link local address
+		// IPv4, see https://www.iana.org/assignments/iana-ipv4-special-registry
+		"0.0.0.0/8",          // "this network"
+		"10.0.0.0/8",         // 24-bit block
+		"100.64.0.0/10",      // carrier-grade NAT shared address space
+		"127.0.0.1/8",        // localhost
+		"169.254.0.0/16",     // link local address
+		"172.16.0.0/12",      // 20-bit block
+		"192.0.0.0/24",       // IETF protocol assignments
+		"192.0.2.0/24",       // documentation (TEST-NET-1)
+		"192.168.0.0/16",     // 16-bit block
+		"198.18.0.0/15",      // benchmarking
+		"198.51.100.0/24",    // documentation (TEST-NET-2)
+		"203.0.113.0/24",     // documentation (TEST-NET-3)
+		"224.0.0.0/4",        // multicast
+		"240.0.0.0/4",        // reserved
+		"255.255.255.255/32", // limited broadcast
+		// IPv6, see https://www.iana.org/assignments/iana-ipv6-special-registry
+		"::/128",         // unspecified address
 		"::1/128",        // localhost IPv6
+		"64:ff9b:1::/48", // local-use NAT64
+		"100::/64",       // discard-only
+		"2001::/23",      // IETF protocol assignments, e.g. Teredo, benchmarking and ORCHID
+		"2001:db8::/32",  // documentation
+		"2002::/16",      // 6to4
+		"3fff::/20",      // documentation
+		"5f00::/16",      // segment routing SIDs
 		"fc00::/7",       // unique local address IPv6
 		"fe80::/10",      // link local address IPv6
+		"ff00::/8",       // multicast IPv6
 	}
 
-	cidrs = make([]*net.IPNet, len(maxCidrBlocks))
+	cidrs = make([]netip.Prefix, len(maxCidrBlocks))
 	for i, maxCidrBlock := range maxCidrBlocks {
-		_, cidr, err := net.ParseCIDR(maxCidrBlock)
+		cidr, err := netip.ParsePrefix(maxCidrBlock)
 		if err != nil {
 			panic(fmt.Sprintf("failed to parse CIDR block %q: %v", maxCidrBlock, err))
 		}
-		cidrs[i] = cidr
+		cidrs[i] = cidr.Masked()
+	}
+}
+
+// nat64Prefix is the well-known NAT64 prefix, its addresses embed an IPv4 address in the last 32 bits.
+var nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// AddPrivateRanges adds CIDR blocks, e.g. internal ranges, that IPFromRequest never reports as the client IP.
+// IPResolver doesn't use them, its trusted proxies play that role.
+func AddPrivateRanges(ranges ...string) error {
+	parsed := make([]netip.Prefix, 0, len(ranges))
+	for _, r := range ranges {
+		cidr, err := netip.ParsePrefix(r)
+		if err != nil {
+			return fmt.Errorf("failed to parse CIDR block %q: %w", r, err)
+		}
+		parsed = append(parsed, cidr.Masked())
+	}
+	for {
+		old := addedCidrs.Load()
+		var added []netip.Prefix
+		if old != nil {
+			added = append(added, *old...)
+		}
+		added = append(added, parsed...)
+		if addedCidrs.CompareAndSwap(old, &added) {
+			return nil
+		}
+	}
+}
+
+// normalizeAddr unmaps IPv4-mapped IPv6 addresses and extracts the IPv4 address from NAT64 addresses.
+func normalizeAddr(ip netip.Addr) netip.Addr {
+	ip = ip.Unmap()
+	if nat64Prefix.Contains(ip) {
+		b := ip.As16()
+		return netip.AddrFrom4([4]byte(b[12:]))
 	}
+	return ip
 }
 
 // IPFromRequest return client's real public IP address from http request headers.
@@ -38,21 +100,31 @@ func IPFromRequest(r *http.Request) string {
 	//
 	// https://developers.cloudflare.com/fundamentals/get-started/reference/http-request-headers/#cf-connecting-ip
 	if ip := r.Header.Get("Cf-Connecting-Ip"); ip != "" {
-		return ip
+		return normalizeString(ip)
 	}
 
 	// If we have it, try to return the first global address in X-Forwarded-For
-	for _, ip := range strings.Split(r.Header.Get("X-Forwarded-For"), ",") {
-		ip = strings.TrimSpace(ip)
-		isPrivate, err := isPrivateAddress(ip)
-		if !isPrivate && err == nil {
-			return ip
+	// (strings.Cut rather than strings.Split, so the common path doesn't allocate)
+	for xff := r.Header.Get("X-Forwarded-For"); xff != ""; {
+		var ip string
+		ip, xff, _ = strings.Cut(xff, ",")
+		if addr, ok := globalAddress(ip); ok {
+			return addr
+		}
+	}
+
+	// Then the first global address in the standard Forwarded header
+	//
+	// https://www.rfc-editor.org/rfc/rfc7239
+	for _, ip := range forwardedHops(r.Header) {
+		if addr, ok := globalAddress(ip); ok {
+			return addr
 		}
 	}
 
 	// Check X-Real-Ip header next
 	if ip := r.Header.Get("X-Real-Ip"); ip != "" {
-		return ip
+		return normalizeString(ip)
 	}
 
 	// If all else fails, return the remote address
@@ -65,26 +137,53 @@ func IPFromRequest(r *http.Request) string {
 	} else {
 		ip = r.RemoteAddr
 	}
-	return ip
+	return normalizeString(ip)
+}
+
+// normalizeString normalizes the address if it is valid, other values are returned as is.
+func normalizeString(address string) string {
+	ip, err := netip.ParseAddr(strings.TrimSpace(address))
+	if err != nil {
+		return address
+	}
+	if normalized := normalizeAddr(ip); normalized != ip {
+		return normalized.String()
+	}
+	return address
+}
+
+// globalAddress parses and normalizes the address, reporting whether it is a valid global address.
+func globalAddress(address string) (string, bool) {
+	address = strings.TrimSpace(address)
+	ip, err := netip.ParseAddr(address)
+	if err != nil {
+		return "", false
+	}
+	if normalized := normalizeAddr(ip); normalized != ip {
+		ip = normalized
+		address = ip.String()
+	}
+	return address, !isPrivateAddress(ip)
 }
 
-// isPrivateAddress works by checking if the address is under private CIDR blocks.
+// isPrivateAddress works by checking if the address is under private or special-purpose CIDR blocks.
 // List of private CIDR blocks can be seen on :
 //
 // https://en.wikipedia.org/wiki/Private_network
 //
 // https://en.wikipedia.org/wiki/Link-local_address
-func isPrivateAddress(address string) (bool, error) {
-	ipAddress := net.ParseIP(address)
-	if ipAddress == nil {
-		return false, errors.New("address is not valid")
-	}
-
+func isPrivateAddress(ip netip.Addr) bool {
 	for i := range cidrs {
-		if cidrs[i].Contains(ipAddress) {
-			return true, nil
+		if cidrs[i].Contains(ip) {
+			return true
 		}
 	}
-
-	return false, nil
+	if added := addedCidrs.Load(); added != nil {
+		for _, cidr := range *added {
+			if cidr.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
 }
@@ -2,9 +2,11 @@ package http_test
 
 import (
 	"net/http"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	http_internal "github.com/utilitywarehouse/castle-go/http"
 )
@@ -38,6 +40,26 @@ func TestIPFromRequest(t *testing.T) {
 			}, "foobar"),
 			expected: "109.14.23.2",
 		},
+		"forwarded": {
+			input: httpRequest(map[string]string{
+				"X-Real-Ip":       "foo",
+				"X-Forwarded-For": "",
+				"Forwarded":       `for=10.0.0.1;proto=https, for="[2a00:1450:4009::17]:4711"`,
+			}, "foobar"),
+			expected: "2a00:1450:4009::17",
+		},
+		"x-forwarded-for skips special-purpose addresses": {
+			input: httpRequest(map[string]string{
+				"X-Forwarded-For": "100.64.0.1, 0.0.0.0, 198.51.100.7, 224.0.0.1, fd00::1, 2001:db8::1, 2001:0:4136:e378::1, 2002:c000:204::1, ::ffff:109.14.23.2",
+			}, "foobar"),
+			expected: "109.14.23.2",
+		},
+		"x-forwarded-for normalizes nat64 addresses": {
+			input: httpRequest(map[string]string{
+				"X-Forwarded-For": "64:ff9b::c0a8:1, 64:ff9b::6d0e:1702",
+			}, "foobar"),
+			expected: "109.14.23.2",
+		},
 		"x-real-ip": {
 			input: httpRequest(map[string]string{
 				"X-Real-Ip":        "x-real-ip",
@@ -46,6 +68,22 @@ func TestIPFromRequest(t *testing.T) {
 			}, "foobar"),
 			expected: "x-real-ip",
 		},
+		"cf-connecting-ip is normalized": {
+			input: httpRequest(map[string]string{
+				"Cf-Connecting-Ip": "::ffff:109.14.23.2",
+			}, "foobar"),
+			expected: "109.14.23.2",
+		},
+		"x-real-ip is normalized": {
+			input: httpRequest(map[string]string{
+				"X-Real-Ip": "64:ff9b::6d0e:1702",
+			}, "foobar"),
+			expected: "109.14.23.2",
+		},
+		"remote-addr is normalized": {
+			input:    httpRequest(map[string]string{}, "[::ffff:109.14.23.2]:8080"),
+			expected: "109.14.23.2",
+		},
 		"remote-addr": {
 			input: httpRequest(map[string]string{
 				"X-Real-Ip":        "",
@@ -73,3 +111,45 @@ func httpRequest(headers map[string]string, remoteAddr string) *http.Request {
 	}
 	return r
 }
+
+func TestAddPrivateRanges(t *testing.T) {
+	t.Cleanup(http_internal.ResetPrivateRanges)
+	req := httpRequest(map[string]string{"X-Forwarded-For": "8.8.4.4, 8.8.8.8"}, "foobar")
+
+	assert.Equal(t, "8.8.4.4", http_internal.IPFromRequest(req))
+
+	assert.Error(t, http_internal.AddPrivateRanges("foo"))
+	require.NoError(t, http_internal.AddPrivateRanges("8.8.4.0/24"))
+
+	assert.Equal(t, "8.8.8.8", http_internal.IPFromRequest(req))
+}
+
+func TestAddPrivateRanges_Concurrent(t *testing.T) {
+	t.Cleanup(http_internal.ResetPrivateRanges)
+	req := httpRequest(map[string]string{"X-Forwarded-For": "8.8.4.4, 8.8.8.8, 1.1.1.1"}, "foobar")
+
+	var wg sync.WaitGroup
+	for _, r := range []string{"8.8.4.0/24", "8.8.8.0/24"} {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, http_internal.AddPrivateRanges(r))
+		}()
+		go func() {
+			defer wg.Done()
+			http_internal.IPFromRequest(req)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, "1.1.1.1", http_internal.IPFromRequest(req))
+}
+
+func BenchmarkIPFromRequest(b *testing.B) {
+	req := httpRequest(map[string]string{"X-Forwarded-For": "10.0.0.1, 100.64.0.1, 109.14.23.2"}, "foobar")
+
+	b.ReportAllocs()
+	for b.Loop() {
+		http_internal.IPFromRequest(req)
+	}
+}
@@ -0,0 +1,206 @@
+package http
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// IPResolver extracts the client IP from requests that went through a chain of trusted proxies.
+//
+// Unlike IPFromRequest, no header is believed unless the request's RemoteAddr is a trusted proxy.
+type IPResolver struct {
+	trustedProxies []netip.Prefix
+	trustedHeader  string
+	useForwarded   bool
+	trustedHops    int
+	preset         Preset
+}
+
+type IPResolverOpt func(*IPResolver)
+
+// Preset names a CDN or load balancer setup, selecting the header and trust chain it uses.
+type Preset string
+
+const (
+	// PresetCloudflare trusts the Cf-Connecting-Ip header.
+	PresetCloudflare Preset = "cloudflare"
+	// PresetFastly trusts the Fastly-Client-Ip header.
+	PresetFastly Preset = "fastly"
+	// PresetAkamai trusts the True-Client-Ip header.
+	PresetAkamai Preset = "akamai"
+	// PresetAWSALB walks X-Forwarded-For, the ALB appends the address it received the request from.
+	PresetAWSALB Preset = "aws-alb"
+	// PresetGCPLoadBalancer walks X-Forwarded-For, skipping the load balancer address GCP appends after the client.
+	PresetGCPLoadBalancer Preset = "gcp-lb"
+	// PresetForwarded walks the RFC 7239 Forwarded header.
+	PresetForwarded Preset = "forwarded"
+)
+
+type presetConfig struct {
+	header       string
+	useForwarded bool
+	trustedHops  int
+}
+
+var presets = map[Preset]presetConfig{
+	PresetCloudflare:      {header: "Cf-Connecting-Ip"},
+	PresetFastly:          {header: "Fastly-Client-Ip"},
+	PresetAkamai:          {header: "True-Client-Ip"},
+	PresetAWSALB:          {},
+	PresetGCPLoadBalancer: {trustedHops: 1},
+	PresetForwarded:       {useForwarded: true},
+}
+
+// WithPreset configures the resolver for a known CDN or load balancer.
+// Options passed explicitly take precedence over the preset.
+func WithPreset(p Preset) IPResolverOpt {
+	return func(r *IPResolver) {
+		r.preset = p
+	}
+}
+
+// WithForwardedHeader makes the resolver walk the RFC 7239 Forwarded header instead of X-Forwarded-For.
+func WithForwardedHeader() IPResolverOpt {
+	return func(r *IPResolver) {
+		r.useForwarded = true
+	}
+}
+
+// WithTrustedHops treats the n rightmost hops of the chain as trusted, whatever their address.
+// This is needed for proxies that append their own, public, address, e.g. GCP load balancers.
+func WithTrustedHops(n int) IPResolverOpt {
+	return func(r *IPResolver) {
+		r.trustedHops = n
+	}
+}
+
+// WithTrustedHeader makes the resolver trust a single client IP header, e.g. Cf-Connecting-Ip,
+// when the request comes from a trusted proxy. It takes precedence over X-Forwarded-For.
+func WithTrustedHeader(name string) IPResolverOpt {
+	return func(r *IPResolver) {
+		r.trustedHeader = name
+	}
+}
+
+// NewIPResolver creates a resolver trusting the given proxies, given as CIDR blocks or single addresses.
+func NewIPResolver(trustedProxies []string, opts ...IPResolverOpt) (*IPResolver, error) {
+	res := &IPResolver{
+		trustedProxies: make([]netip.Prefix, 0, len(trustedProxies)),
+	}
+	for _, p := range trustedProxies {
+		prefix, err := parsePrefix(p)
+		if err != nil {
+			return nil, err
+		}
+		res.trustedProxies = append(res.trustedProxies, prefix)
+	}
+	for _, opt := range opts {
+		opt(res)
+	}
+	if res.preset != "" {
+		cfg, ok := presets[res.preset]
+		if !ok {
+			return nil, fmt.Errorf("unknown preset %q", res.preset)
+		}
+		if res.trustedHeader == "" {
+			res.trustedHeader = cfg.header
+		}
+		if res.trustedHops == 0 {
+			res.trustedHops = cfg.trustedHops
+		}
+		res.useForwarded = res.useForwarded || cfg.useForwarded
+	}
+	return res, nil
+}
+
+// IPFromRequest returns the client IP address of the request.
+//
+// If RemoteAddr is not a trusted proxy it is the client. Otherwise the trusted header is used if set,
+// then X-Forwarded-For (or Forwarded) is walked from the right, returning the first hop that is not a trusted proxy.
+func (res *IPResolver) IPFromRequest(r *http.Request) string {
+	remote, ok := parseAddr(hostFromRemoteAddr(r.RemoteAddr))
+	if !ok {
+		return hostFromRemoteAddr(r.RemoteAddr)
+	}
+	if !res.isTrusted(remote) {
+		return remote.String()
+	}
+
+	if res.trustedHeader != "" {
+		if ip, ok := parseAddr(r.Header.Get(res.trustedHeader)); ok {
+			return ip.String()
+		}
+	}
+
+	hops := forwardedFor(r.Header)
+	if res.useForwarded {
+		hops = forwardedHops(r.Header)
+	}
+
+	client := remote
+	for i, n := len(hops)-1, 0; i >= 0; i, n = i-1, n+1 {
+		ip, ok := parseAddr(hops[i])
+		if !ok {
+			// anything further left was written by an untrusted party
+			break
+		}
+		client = ip
+		if n >= res.trustedHops && !res.isTrusted(ip) {
+			break
+		}
+	}
+	return client.String()
+}
+
+func (res *IPResolver) isTrusted(ip netip.Addr) bool {
+	for _, p := range res.trustedProxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the hops of all X-Forwarded-For headers, in order.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	for _, v := range h.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	return hops
+}
+
+func parseAddr(s string) (netip.Addr, bool) {
+	ip, err := netip.ParseAddr(strings.TrimSpace(s))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return normalizeAddr(ip), true
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.ContainsRune(s, '/') {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid trusted proxy %q: %w", s, err)
+		}
+		return prefix.Masked(), nil
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid trusted proxy %q: %w", s, err)
+	}
+	ip = normalizeAddr(ip)
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+// hostFromRemoteAddr removes the port number from the remote address, if there is one.
+func hostFromRemoteAddr(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
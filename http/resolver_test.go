@@ -0,0 +1,197 @@
+package http_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	http_internal "github.com/utilitywarehouse/castle-go/http"
+)
+
+func TestNewIPResolver(t *testing.T) {
+	_, err := http_internal.NewIPResolver([]string{"10.0.0.0/8", "192.168.1.1", "::1"})
+	require.NoError(t, err)
+
+	_, err = http_internal.NewIPResolver([]string{"10.0.0.0/33"})
+	assert.ErrorContains(t, err, `invalid trusted proxy "10.0.0.0/33"`)
+
+	_, err = http_internal.NewIPResolver([]string{"foo"})
+	assert.ErrorContains(t, err, `invalid trusted proxy "foo"`)
+}
+
+func TestIPResolver_IPFromRequest(t *testing.T) {
+	res, err := http_internal.NewIPResolver(
+		[]string{"10.0.0.0/8", "2001:db8::/32"},
+		http_internal.WithTrustedHeader("Cf-Connecting-Ip"),
+	)
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		headers    map[string]string
+		remoteAddr string
+		expected   string
+	}{
+		"untrusted remote ignores headers": {
+			headers: map[string]string{
+				"Cf-Connecting-Ip": "1.1.1.1",
+				"X-Forwarded-For":  "2.2.2.2",
+			},
+			remoteAddr: "3.3.3.3:1234",
+			expected:   "3.3.3.3",
+		},
+		"trusted remote uses trusted header": {
+			headers: map[string]string{
+				"Cf-Connecting-Ip": "1.1.1.1",
+				"X-Forwarded-For":  "2.2.2.2",
+			},
+			remoteAddr: "10.0.0.1:1234",
+			expected:   "1.1.1.1",
+		},
+		"invalid trusted header falls back to x-forwarded-for": {
+			headers: map[string]string{
+				"Cf-Connecting-Ip": "foo",
+				"X-Forwarded-For":  "2.2.2.2",
+			},
+			remoteAddr: "10.0.0.1:1234",
+			expected:   "2.2.2.2",
+		},
+		"x-forwarded-for is walked from the right": {
+			headers: map[string]string{
+				"X-Forwarded-For": "6.6.6.6, 5.5.5.5, 10.0.0.2, 10.0.0.3",
+			},
+			remoteAddr: "10.0.0.1:1234",
+			expected:   "5.5.5.5",
+		},
+		"x-forwarded-for with only trusted hops": {
+			headers: map[string]string{
+				"X-Forwarded-For": "10.0.0.3, 10.0.0.2",
+			},
+			remoteAddr: "10.0.0.1:1234",
+			expected:   "10.0.0.3",
+		},
+		"x-forwarded-for stops at invalid hop": {
+			headers: map[string]string{
+				"X-Forwarded-For": "6.6.6.6, garbage, 10.0.0.2",
+			},
+			remoteAddr: "10.0.0.1:1234",
+			expected:   "10.0.0.2",
+		},
+		"ipv6 remote": {
+			headers: map[string]string{
+				"X-Forwarded-For": "2001:db8::2, 2001:db8::1",
+			},
+			remoteAddr: "[2001:db8::3]:1234",
+			expected:   "2001:db8::2",
+		},
+		"ipv4 mapped remote": {
+			headers:    map[string]string{"X-Forwarded-For": "4.4.4.4"},
+			remoteAddr: "[::ffff:10.0.0.1]:1234",
+			expected:   "4.4.4.4",
+		},
+		"trusted remote without headers": {
+			headers:    map[string]string{},
+			remoteAddr: "10.0.0.1:1234",
+			expected:   "10.0.0.1",
+		},
+		"unparsable remote": {
+			headers:    map[string]string{"X-Forwarded-For": "4.4.4.4"},
+			remoteAddr: "remote-addr:8080",
+			expected:   "remote-addr",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := res.IPFromRequest(httpRequest(test.headers, test.remoteAddr))
+			assert.Equal(t, test.expected, got)
+		})
+	}
+}
+
+func TestIPResolver_Presets(t *testing.T) {
+	tests := map[string]struct {
+		opts       []http_internal.IPResolverOpt
+		headers    map[string]string
+		remoteAddr string
+		expected   string
+	}{
+		"fastly": {
+			opts: []http_internal.IPResolverOpt{http_internal.WithPreset(http_internal.PresetFastly)},
+			headers: map[string]string{
+				"Fastly-Client-Ip": "1.1.1.1",
+				"X-Forwarded-For":  "2.2.2.2",
+			},
+			remoteAddr: "10.0.0.1:1234",
+			expected:   "1.1.1.1",
+		},
+		"akamai": {
+			opts: []http_internal.IPResolverOpt{http_internal.WithPreset(http_internal.PresetAkamai)},
+			headers: map[string]string{
+				"True-Client-Ip":  "1.1.1.1",
+				"X-Forwarded-For": "2.2.2.2",
+			},
+			remoteAddr: "10.0.0.1:1234",
+			expected:   "1.1.1.1",
+		},
+		"aws alb": {
+			opts: []http_internal.IPResolverOpt{http_internal.WithPreset(http_internal.PresetAWSALB)},
+			headers: map[string]string{
+				"Cf-Connecting-Ip": "6.6.6.6",
+				"X-Forwarded-For":  "6.6.6.6, 2.2.2.2",
+			},
+			remoteAddr: "10.0.0.1:1234",
+			expected:   "2.2.2.2",
+		},
+		"gcp load balancer skips its own address": {
+			opts: []http_internal.IPResolverOpt{http_internal.WithPreset(http_internal.PresetGCPLoadBalancer)},
+			headers: map[string]string{
+				"X-Forwarded-For": "6.6.6.6, 2.2.2.2, 35.191.0.1",
+			},
+			remoteAddr: "10.0.0.1:1234",
+			expected:   "2.2.2.2",
+		},
+		"explicit option wins over preset": {
+			opts: []http_internal.IPResolverOpt{
+				http_internal.WithPreset(http_internal.PresetCloudflare),
+				http_internal.WithTrustedHeader("X-Client-Ip"),
+			},
+			headers: map[string]string{
+				"Cf-Connecting-Ip": "6.6.6.6",
+				"X-Client-Ip":      "1.1.1.1",
+			},
+			remoteAddr: "10.0.0.1:1234",
+			expected:   "1.1.1.1",
+		},
+		"forwarded": {
+			opts: []http_internal.IPResolverOpt{http_internal.WithPreset(http_internal.PresetForwarded)},
+			headers: map[string]string{
+				"X-Forwarded-For": "6.6.6.6",
+				"Forwarded":       `for=6.6.6.6, for="[2001:db8:cafe::17]:4711";proto=https, for=10.0.0.2:8080`,
+			},
+			remoteAddr: "10.0.0.1:1234",
+			expected:   "2001:db8:cafe::17",
+		},
+		"forwarded stops at obfuscated node": {
+			opts: []http_internal.IPResolverOpt{http_internal.WithForwardedHeader()},
+			headers: map[string]string{
+				"Forwarded": `for=6.6.6.6, for=_hidden, for=10.0.0.2`,
+			},
+			remoteAddr: "10.0.0.1:1234",
+			expected:   "10.0.0.2",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			res, err := http_internal.NewIPResolver([]string{"10.0.0.0/8"}, test.opts...)
+			require.NoError(t, err)
+
+			got := res.IPFromRequest(httpRequest(test.headers, test.remoteAddr))
+			assert.Equal(t, test.expected, got)
+		})
+	}
+
+	t.Run("unknown preset", func(t *testing.T) {
+		_, err := http_internal.NewIPResolver(nil, http_internal.WithPreset("foo"))
+		assert.ErrorContains(t, err, `unknown preset "foo"`)
+	})
+}
@@ -0,0 +1,101 @@
+package castle
+
+import (
+	"context"
+	"fmt"
+)
+
+// Endpoint identifies the Castle API endpoint a request is sent to.
+type Endpoint string
+
+const (
+	EndpointFilter Endpoint = "filter"
+	EndpointRisk   Endpoint = "risk"
+)
+
+// Invoker sends the request to the endpoint and returns the decoded decision.
+type Invoker func(ctx context.Context, endpoint Endpoint, req *Request) (*Decision, error)
+
+// Interceptor wraps the calls to Castle, like gRPC client interceptors. It may change the request
+// before calling next, inspect or replace the decision afterwards, or return without calling next at all.
+//
+// The request is a shallow copy of the one passed to Filter or Risk, so its fields can be reassigned freely,
+// but maps such as Properties are shared with the caller and must be copied before being modified.
+type Interceptor func(ctx context.Context, endpoint Endpoint, req *Request, next Invoker) (*Decision, error)
+
+// WithInterceptors adds interceptors to the client, the first one being the outermost.
+// It can be passed several times, the interceptors are appended.
+func WithInterceptors(interceptors ...Interceptor) Opt {
+	return func(o *options) {
+		o.interceptors = append(o.interceptors, interceptors...)
+	}
+}
+
+// ChainInterceptors combines interceptors into one, the first one being the outermost.
+func ChainInterceptors(interceptors ...Interceptor) Interceptor {
+	switch len(interceptors) {
+	case 0:
+		return nil
+	case 1:
+		return interceptors[0]
+	}
+	return func(ctx context.Context, endpoint Endpoint, req *Request, next Invoker) (*Decision, error) {
+		return interceptors[0](ctx, endpoint, req, chainedInvoker(interceptors[1:], next))
+	}
+}
+
+func chainedInvoker(interceptors []Interceptor, final Invoker) Invoker {
+	if len(interceptors) == 0 {
+		return final
+	}
+	return func(ctx context.Context, endpoint Endpoint, req *Request) (*Decision, error) {
+		return interceptors[0](ctx, endpoint, req, chainedInvoker(interceptors[1:], final))
+	}
+}
+
+// invoke runs the interceptors around the call to the endpoint.
+func (c *Castle) invoke(ctx context.Context, endpoint Endpoint, req *Request) (*Decision, error) {
+	r := *req
+	if c.interceptor == nil {
+		return c.send(ctx, endpoint, &r)
+	}
+	return c.interceptor(ctx, endpoint, &r, c.send)
+}
+
+// send is the final invoker: sampling, normalization and then the privacy policy apply to what the interceptors pass on.
+// The last two rewrite a shallow copy of the request, so they clone the maps and pointers they change first.
+func (c *Castle) send(ctx context.Context, endpoint Endpoint, req *Request) (*Decision, error) {
+	if c.sampling != nil {
+		if s := c.sampling(endpoint, req.Event.EventType); !s.sends(req) {
+			if c.metricsEnabled {
+				castleReqsCounter.WithLabelValues(c.endpointURL(endpoint), "skipped", c.tenant).Inc()
+			}
+			return c.skipped(s.Fallback), nil
+		}
+	}
+	if c.normalization != nil || c.privacy != nil {
+		r := *req
+		if c.normalization != nil {
+			c.normalization.apply(endpoint, &r)
+		}
+		if c.privacy != nil {
+			c.privacy.apply(&r)
+		}
+		req = &r
+	}
+	switch endpoint {
+	case EndpointFilter:
+		return c.filter(ctx, req)
+	case EndpointRisk:
+		return c.risk(ctx, req)
+	default:
+		return nil, fmt.Errorf("unknown castle endpoint %q", endpoint)
+	}
+}
+
+func (c *Castle) endpointURL(endpoint Endpoint) string {
+	if endpoint == EndpointRisk {
+		return c.riskURL()
+	}
+	return c.filterURL()
+}
@@ -0,0 +1,78 @@
+package castle_test
+
+import (
+	"context"
+	"maps"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/utilitywarehouse/castle-go"
+)
+
+func TestInterceptors(t *testing.T) {
+	t.Run("order", func(t *testing.T) {
+		var trace []string
+		tracing := func(name string) castle.Interceptor {
+			return func(ctx context.Context, endpoint castle.Endpoint, req *castle.Request, next castle.Invoker) (*castle.Decision, error) {
+				trace = append(trace, name+" before "+string(endpoint))
+				d, err := next(ctx, endpoint, req)
+				trace = append(trace, name+" after "+string(d.Action))
+				return d, err
+			}
+		}
+
+		got := map[string]any{}
+		cstl := newCapturingClient(t, got,
+			castle.WithInterceptors(tracing("first")),
+			castle.WithInterceptors(castle.ChainInterceptors(tracing("second"), tracing("third"))),
+		)
+
+		_, err := cstl.Risk(context.Background(), configureRequest(configureHTTPRequest()))
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"first before risk",
+			"second before risk",
+			"third before risk",
+			"third after allow",
+			"second after allow",
+			"first after allow",
+		}, trace)
+	})
+
+	t.Run("modify request", func(t *testing.T) {
+		got := map[string]any{}
+		cstl := newCapturingClient(t, got, castle.WithInterceptors(
+			func(ctx context.Context, endpoint castle.Endpoint, req *castle.Request, next castle.Invoker) (*castle.Decision, error) {
+				req.TypedProperties = maps.Clone(req.TypedProperties).Set("service", "login")
+				req.User.ID = "rewritten-" + req.User.ID
+				return next(ctx, endpoint, req)
+			},
+		))
+
+		req := configureRequest(configureHTTPRequest())
+		_, err := cstl.Filter(context.Background(), req)
+		require.NoError(t, err)
+
+		assert.Equal(t, map[string]any{"prop1": "propValue1", "service": "login"}, got["properties"])
+		assert.Equal(t, "rewritten-user-id", got["params"].(map[string]any)["username"])
+		// the caller's request is untouched
+		assert.Equal(t, "user-id", req.User.ID)
+		assert.Nil(t, req.TypedProperties)
+	})
+
+	t.Run("short-circuit", func(t *testing.T) {
+		got := map[string]any{}
+		cstl := newCapturingClient(t, got, castle.WithInterceptors(
+			func(context.Context, castle.Endpoint, *castle.Request, castle.Invoker) (*castle.Decision, error) {
+				return &castle.Decision{Action: castle.RecommendedActionDeny}, nil
+			},
+		))
+
+		action, err := cstl.Filter(context.Background(), configureRequest(configureHTTPRequest()))
+		require.NoError(t, err)
+		assert.Equal(t, castle.RecommendedActionDeny, action)
+		assert.Empty(t, got)
+	})
+}
@@ -0,0 +1,64 @@
+package castle
+
+import (
+	"context"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// latencyWindow is the number of recent calls the latency percentile is computed over.
+	latencyWindow = 256
+	// latencyMinSamples is the number of calls observed before any call is skipped.
+	latencyMinSamples = 16
+	// latencyRefresh is the number of calls between two computations of the percentile.
+	latencyRefresh = 16
+)
+
+// latencyTracker keeps the latency of recent Castle calls and a cached percentile of it.
+type latencyTracker struct {
+	percentile float64
+
+	mu      sync.Mutex
+	samples [latencyWindow]time.Duration
+	count   int
+	next    int
+
+	estimate atomic.Int64
+}
+
+func newLatencyTracker(percentile float64) *latencyTracker {
+	return &latencyTracker{percentile: min(max(percentile, 0), 1)}
+}
+
+func (t *latencyTracker) record(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.samples[t.next] = d
+	t.next = (t.next + 1) % latencyWindow
+	t.count++
+	if t.count < latencyMinSamples || t.count%latencyRefresh != 0 {
+		return
+	}
+
+	var sorted [latencyWindow]time.Duration
+	n := min(t.count, latencyWindow)
+	copy(sorted[:], t.samples[:n])
+	slices.Sort(sorted[:n])
+	i := int(math.Ceil(t.percentile*float64(n))) - 1
+	t.estimate.Store(int64(sorted[max(i, 0)]))
+}
+
+// tooLate reports whether the deadline of ctx is closer than the latency percentile.
+func (t *latencyTracker) tooLate(ctx context.Context) bool {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return false
+	}
+	estimate := time.Duration(t.estimate.Load())
+	return estimate > 0 && time.Until(deadline) < estimate
+}
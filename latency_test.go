@@ -0,0 +1,121 @@
+package castle_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/utilitywarehouse/castle-go"
+)
+
+func TestLatencyBudget(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusCreated)
+		_, err := w.Write([]byte(`{"policy": {"action": "deny"}}`))
+		assert.NoError(t, err)
+	}))
+	t.Cleanup(ts.Close)
+
+	cstl, err := castle.New("secret-string",
+		castle.WithEndpoints(ts.URL, ts.URL),
+		castle.WithLatencyBudget(0.9),
+		castle.WithFallback(castle.RecommendedActionAllow),
+	)
+	require.NoError(t, err)
+	req := configureRequest(configureHTTPRequest())
+
+	tight := func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(context.Background(), 5*time.Millisecond)
+	}
+
+	// not enough calls observed yet, Castle is called and the call times out
+	ctx, cancel := tight()
+	_, err = cstl.Filter(ctx, req)
+	cancel()
+	require.Error(t, err)
+
+	for range 16 {
+		action, err := cstl.Filter(context.Background(), req)
+		require.NoError(t, err)
+		assert.Equal(t, castle.RecommendedActionDeny, action)
+	}
+	before := calls.Load()
+
+	ctx, cancel = tight()
+	defer cancel()
+	decision, err := cstl.FilterDecision(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, &castle.Decision{Action: castle.RecommendedActionAllow, Skipped: true}, decision)
+	assert.Equal(t, before, calls.Load())
+	assert.Equal(t, 1.0, requestsTotal(t, ts.URL, "skipped"))
+
+	// enough time left
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	action, err := cstl.Filter(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, castle.RecommendedActionDeny, action)
+}
+
+func TestLatencyBudget_FailedCalls(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		<-release
+	}))
+	t.Cleanup(ts.Close)
+	t.Cleanup(func() { close(release) })
+
+	cstl, err := castle.New("secret-string",
+		castle.WithEndpoints(ts.URL, ts.URL),
+		castle.WithTimeout(20*time.Millisecond),
+		castle.WithLatencyBudget(0.5),
+		castle.WithFallback(castle.RecommendedActionAllow),
+	)
+	require.NoError(t, err)
+	req := configureRequest(configureHTTPRequest())
+
+	// every call times out, they are recorded as taking the whole timeout
+	for range 16 {
+		_, err := cstl.Filter(context.Background(), req)
+		require.Error(t, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	decision, err := cstl.FilterDecision(ctx, req)
+	require.NoError(t, err)
+	assert.True(t, decision.Skipped)
+}
+
+// requestsTotal returns the requests counter for the endpoint and status.
+func requestsTotal(t *testing.T, endpoint, status string) float64 {
+	t.Helper()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() != "iam_castle_requests_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["endpoint"] == endpoint && labels["status"] == status {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,238 @@
+package castle
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Client is implemented by Castle and MultiTenant.
+type Client interface {
+	Filterer
+	Risk(ctx context.Context, req *Request) (RecommendedAction, error)
+}
+
+// LoginOutcome is an enum defining the result of a login attempt.
+type LoginOutcome int
+
+const (
+	// LoginOutcomeUnknown means no event is sent, e.g. for server errors.
+	LoginOutcomeUnknown LoginOutcome = iota
+	LoginOutcomeSucceeded
+	LoginOutcomeFailed
+)
+
+// UserResolver returns the user of a request, r is the request as seen by the login handler.
+type UserResolver func(r *http.Request) (User, error)
+
+// DefaultLoginOutcome treats 2xx and 3xx responses as successful logins and 4xx responses as failed ones.
+func DefaultLoginOutcome(status int) LoginOutcome {
+	switch {
+	case status >= 200 && status < 400:
+		return LoginOutcomeSucceeded
+	case status >= 400 && status < 500:
+		return LoginOutcomeFailed
+	default:
+		return LoginOutcomeUnknown
+	}
+}
+
+type loginState struct {
+	mu      sync.Mutex
+	outcome LoginOutcome
+	user    *User
+}
+
+var loginStateCtxKey = contextKey("castle_login_state")
+
+// SetLoginOutcome records the outcome of the login in the context of a request handled by LoginTrackingMiddleware,
+// taking precedence over the response status code. The user is optional, it saves resolving it again.
+// It reports whether the context belongs to such a request.
+func SetLoginOutcome(ctx context.Context, outcome LoginOutcome, user *User) bool {
+	state, ok := ctx.Value(loginStateCtxKey).(*loginState)
+	if !ok {
+		return false
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.outcome = outcome
+	state.user = user
+	return true
+}
+
+// WithLoginOutcome sets the function deriving the login outcome from the response status code in
+// LoginTrackingMiddleware, DefaultLoginOutcome is used otherwise.
+func WithLoginOutcome(fn func(status int) LoginOutcome) MiddlewareOpt {
+	return func(o *middlewareOpts) {
+		o.loginOutcome = fn
+	}
+}
+
+// WithTrackingErrorHandler sets the function called with errors resolving the user or sending the events in the background.
+func WithTrackingErrorHandler(fn func(err error)) MiddlewareOpt {
+	return func(o *middlewareOpts) {
+		o.trackingErrorHandler = fn
+	}
+}
+
+// WithTrackingTimeout sets the timeout of the events sent in the background, it defaults to 10 seconds.
+func WithTrackingTimeout(d time.Duration) MiddlewareOpt {
+	return func(o *middlewareOpts) {
+		o.trackingTimeout = d
+	}
+}
+
+// LoginTrackingMiddleware tracks the outcome of login requests: once the handler is done, it sends a
+// $login $succeeded event to Risk for successful logins or a $login $failed event to Filter for failed ones,
+// in the background.
+//
+// The outcome is the one set with SetLoginOutcome, or derived from the response status code otherwise.
+// Successful logins use the user passed to SetLoginOutcome or resolveUser, failed ones resolveAttempt,
+// which should return the identity the login was attempted with. Resolvers are called before the middleware
+// returns, so they can still read the request body.
+//
+// It accepts the same options as Middleware and also injects the Castle context. Like EnforcementMiddleware,
+// requests without a request token are tracked too, unless WithIgnoreEmpty(true) is passed.
+// It panics if a resolver is nil.
+func LoginTrackingMiddleware(c Client, resolveUser, resolveAttempt UserResolver, opts ...MiddlewareOpt) func(next http.Handler) http.Handler {
+	if resolveUser == nil || resolveAttempt == nil {
+		panic("castle: LoginTrackingMiddleware requires both resolveUser and resolveAttempt")
+	}
+	options := &middlewareOpts{
+		methods:         []string{http.MethodPost},
+		loginOutcome:    DefaultLoginOutcome,
+		trackingTimeout: 10 * time.Second,
+	}
+
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !options.matches(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			castleCtx := fromHTTPRequest(r, options.headerPolicy, options.clientIP, options.tokenExtractor)
+			if options.ignoreEmpty && castleCtx.RequestToken == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			state := &loginState{}
+			ctx := context.WithValue(ToCtx(r.Context(), castleCtx), loginStateCtxKey, state)
+			r = r.WithContext(ctx)
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+			next.ServeHTTP(sw, r)
+
+			state.mu.Lock()
+			outcome, user := state.outcome, state.user
+			state.mu.Unlock()
+			if outcome == LoginOutcomeUnknown {
+				outcome = options.loginOutcome(sw.status)
+			}
+			if outcome == LoginOutcomeUnknown {
+				return
+			}
+
+			// resolvers may read the request body, which is closed once the handler returns
+			req, err := loginRequest(r, castleCtx, outcome, user, resolveUser, resolveAttempt)
+			if err != nil {
+				if options.trackingErrorHandler != nil {
+					options.trackingErrorHandler(err)
+				}
+				return
+			}
+
+			go func() {
+				ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), options.trackingTimeout)
+				defer cancel()
+
+				if err := trackLogin(ctx, c, req); err != nil && options.trackingErrorHandler != nil {
+					options.trackingErrorHandler(err)
+				}
+			}()
+		})
+	}
+}
+
+// loginRequest builds the login event, resolving the user unless the handler passed it to SetLoginOutcome.
+func loginRequest(r *http.Request, castleCtx *Context, outcome LoginOutcome, user *User, resolveUser, resolveAttempt UserResolver) (*Request, error) {
+	req := &Request{
+		Context: castleCtx,
+		Event:   Event{EventType: EventTypeLogin, EventStatus: EventStatusSucceeded},
+	}
+	resolve := resolveUser
+	if outcome != LoginOutcomeSucceeded {
+		req.Event.EventStatus = EventStatusFailed
+		resolve = resolveAttempt
+	}
+
+	if user == nil {
+		u, err := resolve(r)
+		if err != nil {
+			return nil, err
+		}
+		user = &u
+	}
+	req.User = *user
+	return req, nil
+}
+
+// trackLogin sends successful logins to Risk and failed ones to Filter.
+func trackLogin(ctx context.Context, c Client, req *Request) error {
+	var err error
+	if req.Event.EventStatus == EventStatusSucceeded {
+		_, err = c.Risk(ctx, req)
+	} else {
+		_, err = c.Filter(ctx, req)
+	}
+	return err
+}
+
+// statusWriter records the status code written by the handler.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher for handlers that type-assert it, it does nothing if the underlying writer can't flush.
+func (w *statusWriter) Flush() {
+	w.wroteHeader = true
+	http.NewResponseController(w.ResponseWriter).Flush() // nolint: errcheck
+}
+
+// Hijack implements http.Hijacker for handlers that type-assert it. Hijacked requests have no status code,
+// they are recorded as 101 Switching Protocols.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil && !w.wroteHeader {
+		w.status = http.StatusSwitchingProtocols
+		w.wroteHeader = true
+	}
+	return conn, rw, err
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
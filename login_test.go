@@ -0,0 +1,184 @@
+package castle_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/utilitywarehouse/castle-go"
+)
+
+type trackedEvent struct {
+	endpoint string
+	body     map[string]any
+}
+
+// postLogin posts a login form through a real server, which closes the request body once the handler returns.
+func postLogin(t *testing.T, appURL string) {
+	t.Helper()
+	form := url.Values{"email": {"user@test.com"}, "password": {"password"}}
+	req, err := http.NewRequest(http.MethodPost, appURL+"/login", strings.NewReader(form.Encode()))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Castle-Request-Token", "token")
+
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+}
+
+func TestLoginTrackingMiddleware(t *testing.T) {
+	events := make(chan trackedEvent, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]any{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		events <- trackedEvent{endpoint: r.URL.Path, body: body}
+
+		w.WriteHeader(http.StatusCreated)
+		_, err := w.Write([]byte(`{"policy": {"action": "allow"}}`))
+		assert.NoError(t, err)
+	}))
+	t.Cleanup(ts.Close)
+
+	cstl, err := castle.New("secret-string", castle.WithEndpoints(ts.URL+"/filter", ts.URL+"/risk"))
+	require.NoError(t, err)
+
+	resolveUser := func(*http.Request) (castle.User, error) {
+		return castle.User{ID: "resolved-user"}, nil
+	}
+	resolveAttempt := func(r *http.Request) (castle.User, error) {
+		return castle.User{Email: r.FormValue("email")}, nil
+	}
+
+	tests := map[string]struct {
+		handler          http.HandlerFunc
+		expectedEndpoint string
+		expectedStatus   string
+		expectedUser     map[string]any
+		expectedParams   map[string]any
+	}{
+		"succeeded from status": {
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusFound)
+			},
+			expectedEndpoint: "/risk",
+			expectedStatus:   "$succeeded",
+			expectedUser:     map[string]any{"id": "resolved-user"},
+		},
+		"failed from status": {
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusUnauthorized)
+			},
+			expectedEndpoint: "/filter",
+			expectedStatus:   "$failed",
+			expectedParams:   map[string]any{"email": "user@test.com"},
+		},
+		"succeeded set by handler": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				assert.NotNil(t, castle.FromCtx(r.Context()))
+				assert.True(t, castle.SetLoginOutcome(r.Context(), castle.LoginOutcomeSucceeded, &castle.User{ID: "handler-user"}))
+				// e.g. an error page rendered with a 200
+				w.WriteHeader(http.StatusOK)
+			},
+			expectedEndpoint: "/risk",
+			expectedStatus:   "$succeeded",
+			expectedUser:     map[string]any{"id": "handler-user"},
+		},
+		"failed set by handler": {
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				castle.SetLoginOutcome(r.Context(), castle.LoginOutcomeFailed, nil)
+				w.WriteHeader(http.StatusOK)
+			},
+			expectedEndpoint: "/filter",
+			expectedStatus:   "$failed",
+			expectedParams:   map[string]any{"email": "user@test.com"},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			app := httptest.NewServer(castle.LoginTrackingMiddleware(cstl, resolveUser, resolveAttempt)(test.handler))
+			t.Cleanup(app.Close)
+
+			postLogin(t, app.URL)
+
+			select {
+			case got := <-events:
+				assert.Equal(t, test.expectedEndpoint, got.endpoint)
+				assert.Equal(t, "$login", got.body["type"])
+				assert.Equal(t, test.expectedStatus, got.body["status"])
+				if test.expectedUser != nil {
+					assert.Equal(t, test.expectedUser, got.body["user"])
+				}
+				if test.expectedParams != nil {
+					assert.Equal(t, test.expectedParams, got.body["params"])
+				}
+			case <-time.After(time.Second):
+				t.Fatal("expected an event to be sent")
+			}
+		})
+	}
+
+	t.Run("unknown outcome", func(t *testing.T) {
+		handler := castle.LoginTrackingMiddleware(cstl, resolveUser, resolveAttempt)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+
+		req := httptest.NewRequest(http.MethodPost, "/login", nil)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		select {
+		case <-events:
+			t.Fatal("expected no event to be sent")
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+
+	t.Run("resolver error", func(t *testing.T) {
+		errs := make(chan error, 1)
+		handler := castle.LoginTrackingMiddleware(cstl, func(*http.Request) (castle.User, error) {
+			return castle.User{}, errors.New("no user")
+		}, resolveAttempt, castle.WithTrackingErrorHandler(func(err error) {
+			errs <- err
+		}))(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+		req := httptest.NewRequest(http.MethodPost, "/login", nil)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		select {
+		case err := <-errs:
+			assert.EqualError(t, err, "no user")
+		case <-time.After(time.Second):
+			t.Fatal("expected the error handler to be called")
+		}
+	})
+	t.Run("flusher", func(t *testing.T) {
+		var flushed bool
+		handler := castle.LoginTrackingMiddleware(cstl, resolveUser, resolveAttempt)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			f, ok := w.(http.Flusher)
+			require.True(t, ok)
+			f.Flush()
+			flushed = true
+		}))
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/login", nil))
+		assert.True(t, flushed)
+		assert.True(t, rec.Flushed)
+
+		event := <-events
+		assert.Equal(t, "/risk", event.endpoint)
+	})
+
+	t.Run("nil resolver", func(t *testing.T) {
+		assert.Panics(t, func() { castle.LoginTrackingMiddleware(cstl, nil, resolveAttempt) })
+		assert.Panics(t, func() { castle.LoginTrackingMiddleware(cstl, resolveUser, nil) })
+	})
+}
@@ -1,24 +1,111 @@
 package castle
 
-import "net/http"
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
 
 type middlewareOpts struct {
-	methodFilter string
-	pathFilter   string
-	ignoreEmpty  bool
+	methods        []string
+	matchers       []func(*http.Request) bool
+	ignoreEmpty    bool
+	headerPolicy   *HeaderPolicy
+	clientIP       func(*http.Request) string
+	tokenExtractor TokenExtractor
+
+	// only used by EnforcementMiddleware
+	denyHandler      http.Handler
+	challengeHandler http.Handler
+	errorHandler     func(w http.ResponseWriter, r *http.Request, err error)
+
+	// only used by LoginTrackingMiddleware
+	loginOutcome         func(status int) LoginOutcome
+	trackingErrorHandler func(err error)
+	trackingTimeout      time.Duration
 }
 
 type MiddlewareOpt func(*middlewareOpts)
 
+// WithMethodFilter restricts the middleware to a single method, an empty method allows any.
 func WithMethodFilter(method string) MiddlewareOpt {
+	if method == "" {
+		return WithMethods()
+	}
+	return WithMethods(method)
+}
+
+// WithMethods restricts the middleware to the given methods, no methods allows any.
+// It replaces the default POST filter.
+func WithMethods(methods ...string) MiddlewareOpt {
 	return func(o *middlewareOpts) {
-		o.methodFilter = method
+		o.methods = methods
 	}
 }
 
-func WithPathFilter(path string) MiddlewareOpt {
+// WithPathFilter restricts the middleware to an exact path, an empty path adds no restriction.
+//
+// Path options (WithPathFilter, WithPathPrefix, WithPathGlob, WithServeMuxPatterns and WithMatcher)
+// can be combined, a request has to match at least one of them.
+func WithPathFilter(p string) MiddlewareOpt {
+	if p == "" {
+		return func(*middlewareOpts) {}
+	}
+	return WithMatcher(func(r *http.Request) bool {
+		return r.URL.Path == p
+	})
+}
+
+// WithPathPrefix restricts the middleware to paths starting with prefix.
+func WithPathPrefix(prefix string) MiddlewareOpt {
+	return WithMatcher(func(r *http.Request) bool {
+		return strings.HasPrefix(r.URL.Path, prefix)
+	})
+}
+
+// WithPathGlob restricts the middleware to paths matching the path.Match pattern, e.g. "/account/*".
+// Note that * does not match across "/". It panics if the pattern is malformed.
+func WithPathGlob(pattern string) MiddlewareOpt {
+	if _, err := path.Match(pattern, ""); err != nil {
+		panic(fmt.Sprintf("castle: invalid path glob %q: %v", pattern, err))
+	}
+	return WithMatcher(func(r *http.Request) bool {
+		ok, _ := path.Match(pattern, r.URL.Path) //nolint:errcheck // validated above
+		return ok
+	})
+}
+
+// WithServeMuxPatterns restricts the middleware to requests matching any of the http.ServeMux patterns,
+// e.g. "POST /login" or "PUT /account/{id}". Like http.ServeMux, it panics if a pattern is invalid or conflicting.
+// Patterns with a method are still subject to the method filter, pass WithMethods() to disable it.
+// Requests the mux would redirect, e.g. "/account" for the pattern "/account/", don't match.
+func WithServeMuxPatterns(patterns ...string) MiddlewareOpt {
+	mux := http.NewServeMux()
+	matched := &muxMatch{}
+	for _, p := range patterns {
+		mux.Handle(p, matched)
+	}
+	return WithMatcher(func(r *http.Request) bool {
+		// redirects and 405s are served by other handlers
+		h, _ := mux.Handler(r)
+		return h == matched
+	})
+}
+
+// muxMatch is the handler of the patterns registered by WithServeMuxPatterns, it is never served.
+type muxMatch struct{}
+
+func (*muxMatch) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// WithMatcher restricts the middleware to requests for which fn returns true.
+func WithMatcher(fn func(*http.Request) bool) MiddlewareOpt {
 	return func(o *middlewareOpts) {
-		o.pathFilter = path
+		o.matchers = append(o.matchers, fn)
 	}
 }
 
@@ -28,12 +115,33 @@ func WithIgnoreEmpty(ignore bool) MiddlewareOpt {
 	}
 }
 
+// WithHeaderPolicy sets the policy deciding which headers are forwarded to Castle, DefaultHeaderPolicy is used otherwise.
+func WithHeaderPolicy(p *HeaderPolicy) MiddlewareOpt {
+	return func(o *middlewareOpts) {
+		o.headerPolicy = p
+	}
+}
+
+// WithClientIP sets the function extracting the client IP, DefaultClientIP is used otherwise.
+func WithClientIP(fn func(*http.Request) string) MiddlewareOpt {
+	return func(o *middlewareOpts) {
+		o.clientIP = fn
+	}
+}
+
+// WithTokenExtractor sets the function extracting the request token, DefaultTokenExtractor is used otherwise.
+func WithTokenExtractor(fn TokenExtractor) MiddlewareOpt {
+	return func(o *middlewareOpts) {
+		o.tokenExtractor = fn
+	}
+}
+
 // Middleware is a function that wraps an http.Handler to inject the Castle context into the request.
 // If ignoreEmpty is true, it will skip the middleware if the request token is empty.
 func Middleware(opts ...MiddlewareOpt) func(next http.Handler) http.Handler {
 	options := &middlewareOpts{
-		methodFilter: "POST",
-		ignoreEmpty:  true,
+		methods:     []string{http.MethodPost},
+		ignoreEmpty: true,
 	}
 
 	for _, opt := range opts {
@@ -42,15 +150,11 @@ func Middleware(opts ...MiddlewareOpt) func(next http.Handler) http.Handler {
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if options.methodFilter != "" && r.Method != options.methodFilter {
-				next.ServeHTTP(w, r)
-				return
-			}
-			if options.pathFilter != "" && r.URL.Path != options.pathFilter {
+			if !options.matches(r) {
 				next.ServeHTTP(w, r)
 				return
 			}
-			castleCtx := FromHTTPRequest(r)
+			castleCtx := fromHTTPRequest(r, options.headerPolicy, options.clientIP, options.tokenExtractor)
 			if options.ignoreEmpty && castleCtx.RequestToken == "" {
 				next.ServeHTTP(w, r)
 				return
@@ -61,3 +165,15 @@ func Middleware(opts ...MiddlewareOpt) func(next http.Handler) http.Handler {
 		})
 	}
 }
+
+func (o *middlewareOpts) matches(r *http.Request) bool {
+	if len(o.methods) > 0 && !slices.Contains(o.methods, r.Method) {
+		return false
+	}
+	if len(o.matchers) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(o.matchers, func(match func(*http.Request) bool) bool {
+		return match(r)
+	})
+}
@@ -59,3 +59,160 @@ func Test_Middleware(t *testing.T) {
 		}
 	})
 }
+
+func Test_Middleware_Matching(t *testing.T) {
+	tests := map[string]struct {
+		opts     []MiddlewareOpt
+		method   string
+		path     string
+		expected bool
+	}{
+		"default method": {
+			method:   http.MethodPost,
+			path:     "/login",
+			expected: true,
+		},
+		"default method mismatch": {
+			method:   http.MethodGet,
+			path:     "/login",
+			expected: false,
+		},
+		"method filter": {
+			opts:     []MiddlewareOpt{WithMethodFilter(http.MethodPut)},
+			method:   http.MethodPut,
+			path:     "/login",
+			expected: true,
+		},
+		"empty method filter allows any method": {
+			opts:     []MiddlewareOpt{WithMethodFilter("")},
+			method:   http.MethodDelete,
+			path:     "/login",
+			expected: true,
+		},
+		"multiple methods": {
+			opts:     []MiddlewareOpt{WithMethods(http.MethodPost, http.MethodPut)},
+			method:   http.MethodPut,
+			path:     "/login",
+			expected: true,
+		},
+		"exact path mismatch": {
+			opts:     []MiddlewareOpt{WithPathFilter("/login")},
+			method:   http.MethodPost,
+			path:     "/login/foo",
+			expected: false,
+		},
+		"path prefix": {
+			opts:     []MiddlewareOpt{WithPathPrefix("/password-reset/")},
+			method:   http.MethodPost,
+			path:     "/password-reset/confirm",
+			expected: true,
+		},
+		"path glob": {
+			opts:     []MiddlewareOpt{WithPathGlob("/account/*")},
+			method:   http.MethodPost,
+			path:     "/account/email",
+			expected: true,
+		},
+		"path glob does not cross segments": {
+			opts:     []MiddlewareOpt{WithPathGlob("/account/*")},
+			method:   http.MethodPost,
+			path:     "/account/email/verify",
+			expected: false,
+		},
+		"any path option matches": {
+			opts: []MiddlewareOpt{
+				WithPathFilter("/login"),
+				WithPathFilter("/register"),
+				WithPathPrefix("/password-reset/"),
+			},
+			method:   http.MethodPost,
+			path:     "/register",
+			expected: true,
+		},
+		"serve mux pattern": {
+			opts: []MiddlewareOpt{
+				WithMethods(),
+				WithServeMuxPatterns("POST /login", "PUT /account/{field}"),
+			},
+			method:   http.MethodPut,
+			path:     "/account/email",
+			expected: true,
+		},
+		"serve mux pattern method mismatch": {
+			opts: []MiddlewareOpt{
+				WithMethods(),
+				WithServeMuxPatterns("POST /login", "PUT /account/{field}"),
+			},
+			method:   http.MethodPost,
+			path:     "/account/email",
+			expected: false,
+		},
+		"empty path filter adds no matcher": {
+			opts: []MiddlewareOpt{
+				WithPathFilter(""),
+				WithPathPrefix("/account/"),
+			},
+			method:   http.MethodPost,
+			path:     "/login",
+			expected: false,
+		},
+		"empty path filter alone matches any path": {
+			opts:     []MiddlewareOpt{WithPathFilter("")},
+			method:   http.MethodPost,
+			path:     "/login",
+			expected: true,
+		},
+		"serve mux pattern trailing slash redirect": {
+			opts: []MiddlewareOpt{
+				WithMethods(),
+				WithServeMuxPatterns("PUT /account/"),
+			},
+			method:   http.MethodPut,
+			path:     "/account",
+			expected: false,
+		},
+		"serve mux subtree pattern": {
+			opts: []MiddlewareOpt{
+				WithMethods(),
+				WithServeMuxPatterns("PUT /account/"),
+			},
+			method:   http.MethodPut,
+			path:     "/account/email",
+			expected: true,
+		},
+		"custom matcher": {
+			opts: []MiddlewareOpt{WithMatcher(func(r *http.Request) bool {
+				return r.URL.Query().Get("flow") == "signup"
+			})},
+			method:   http.MethodPost,
+			path:     "/?flow=signup",
+			expected: true,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got bool
+			middleware := Middleware(test.opts...)(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				got = FromCtx(r.Context()) != nil
+			}))
+
+			req := httptest.NewRequest(test.method, "https://example.com"+test.path, nil)
+			req.Header.Set("X-Castle-Request-Token", "token")
+
+			middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got != test.expected {
+				t.Errorf("Expected castle context present to be %t, got %t", test.expected, got)
+			}
+		})
+	}
+
+	t.Run("invalid glob panics", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected invalid glob to panic")
+			}
+		}()
+		WithPathGlob("/account/[")
+	})
+}
@@ -1,6 +1,7 @@
 package castle
 
 import (
+	"slices"
 	"strings"
 	"time"
 )
@@ -10,6 +11,62 @@ type Event struct {
 	EventStatus EventStatus
 	// EventName is a $custom event name that can be used to send custom events.
 	Name string
+	// AuthenticationMethod describes how the user authenticated, e.g. for $login and $challenge events.
+	AuthenticationMethod *AuthenticationMethod
+	// Transaction describes the transaction of a $transaction event.
+	Transaction *Transaction
+	// Changeset describes the changed fields of a $profile_update event, keyed by field name.
+	Changeset map[string]Change
+}
+
+// AuthenticationMethodType is an enum defining the ways a user can authenticate.
+type AuthenticationMethodType string
+
+// See https://reference.castle.io/#operation/risk
+const (
+	AuthenticationMethodPassword      AuthenticationMethodType = "$password"
+	AuthenticationMethodSocial        AuthenticationMethodType = "$social"
+	AuthenticationMethodEmail         AuthenticationMethodType = "$email"
+	AuthenticationMethodPhone         AuthenticationMethodType = "$phone"
+	AuthenticationMethodAuthenticator AuthenticationMethodType = "$authenticator"
+	AuthenticationMethodBiometrics    AuthenticationMethodType = "$biometrics"
+)
+
+type AuthenticationMethod struct {
+	Type AuthenticationMethodType `json:"type"`
+	// Variant further qualifies the method, e.g. the social provider or the authenticator app.
+	Variant string `json:"variant,omitempty"`
+}
+
+// AmountType is an enum defining the kinds of transaction amounts.
+type AmountType string
+
+const (
+	AmountTypeFiat   AmountType = "$fiat"
+	AmountTypeCrypto AmountType = "$crypto"
+)
+
+type Transaction struct {
+	ID     string `json:"id,omitempty"`
+	Amount Amount `json:"amount"`
+}
+
+type Amount struct {
+	Type AmountType `json:"type"`
+	// Value is a decimal string, e.g. "49.99", to avoid floating point rounding.
+	Value    string `json:"value"`
+	Currency string `json:"currency"`
+}
+
+// Change describes a single changed field. Sensitive fields such as passwords should only set Changed.
+type Change struct {
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"`
+	Changed bool   `json:"changed,omitempty"`
+}
+
+type Product struct {
+	ID string `json:"id"`
 }
 
 // EventType is an enum defining types of event castle tracks.
@@ -24,6 +81,7 @@ const (
 	EventTypePasswordResetRequest EventType = "$password_reset_request"
 	EventTypeChallenge            EventType = "$challenge"
 	EventTypeLogout               EventType = "$logout"
+	EventTypeTransaction          EventType = "$transaction"
 	EventTypeCustom               EventType = "$custom"
 )
 
@@ -55,7 +113,46 @@ type Request struct {
 	Event      Event
 	User       User
 	Properties map[string]string
-	CreatedAt  time.Time
+	// TypedProperties carries non-string property values, e.g. numbers, booleans or nested objects.
+	// It is merged with Properties, TypedProperties wins on duplicate keys.
+	TypedProperties Properties
+	// Product identifies the product the event belongs to, when a Castle environment covers several.
+	Product *Product
+	// IdentityFields lists the User fields sent as identity fields, i.e. Filter params or the top level Risk user.
+	// The remaining non-empty fields are sent as Filter properties or Risk user traits.
+	// When nil, all fields are identity fields.
+	IdentityFields []UserField
+	// MatchingUserID links an anonymous Filter event to a known user, it is not sent with Risk.
+	MatchingUserID string
+	CreatedAt      time.Time
+}
+
+// Properties holds arbitrary JSON-serialisable values, sent to Castle as event properties or user traits.
+type Properties map[string]any
+
+// Set adds the key and value to the properties, allocating the map if needed.
+// It returns the properties so calls can be chained.
+func (p Properties) Set(key string, value any) Properties {
+	if p == nil {
+		p = make(Properties)
+	}
+	p[key] = value
+	return p
+}
+
+// mergeProperties combines string and typed values into a single map, typed values win on duplicate keys.
+func mergeProperties(strs map[string]string, typed Properties) map[string]any {
+	if len(strs) == 0 && len(typed) == 0 {
+		return nil
+	}
+	merged := make(map[string]any, len(strs)+len(typed))
+	for k, v := range strs {
+		merged[k] = v
+	}
+	for k, v := range typed {
+		merged[k] = v
+	}
+	return merged
 }
 
 // Context captures data from HTTP request.
@@ -70,30 +167,116 @@ type User struct {
 	Email        string            `json:"email,omitempty"`
 	Phone        string            `json:"phone,omitempty"`
 	Name         string            `json:"name,omitempty"`
+	Address      *Address          `json:"address,omitempty"`
 	RegisteredAt string            `json:"registered_at,omitempty"`
 	Traits       map[string]string `json:"traits,omitempty"`
+	// TypedTraits carries non-string trait values, it is merged with Traits, TypedTraits wins on duplicate keys.
+	TypedTraits Properties `json:"-"`
+}
+
+type Address struct {
+	Street   string `json:"line1,omitempty"`
+	City     string `json:"city,omitempty"`
+	Postcode string `json:"postal_code,omitempty"`
+	// Region is the ISO 3166-2 subdivision code, e.g. "ENG".
+	Region string `json:"region_code,omitempty"`
+	// Country is the ISO 3166-1 alpha-2 country code, e.g. "GB".
+	Country string `json:"country_code,omitempty"`
 }
 
 type Params struct {
-	Email    string `json:"email,omitempty"`
-	Phone    string `json:"phone,omitempty"`
-	Username string `json:"username,omitempty"`
+	Email    string   `json:"email,omitempty"`
+	Phone    string   `json:"phone,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Address  *Address `json:"address,omitempty"`
+}
+
+// UserField is an enum defining the identifying fields of User.
+type UserField string
+
+const (
+	// UserFieldID is sent as the username param to Filter. It is always sent as the user ID to Risk.
+	UserFieldID      UserField = "id"
+	UserFieldEmail   UserField = "email"
+	UserFieldPhone   UserField = "phone"
+	UserFieldName    UserField = "name"
+	UserFieldAddress UserField = "address"
+)
+
+func isIdentityField(identity []UserField, f UserField) bool {
+	// by default every identifying field is sent as such
+	if identity == nil {
+		return true
+	}
+	return slices.Contains(identity, f)
+}
+
+// addTrait adds v under key, unless the key is already set or v is empty.
+func addTrait[T comparable](traits map[string]any, key UserField, v T) map[string]any {
+	var zero T
+	if v == zero {
+		return traits
+	}
+	if traits == nil {
+		traits = make(map[string]any)
+	}
+	if _, ok := traits[string(key)]; !ok {
+		traits[string(key)] = v
+	}
+	return traits
+}
+
+// newCastleAPIParams maps the identity fields of u to Filter params.
+// Fields that are not identity fields are added to properties instead, which is returned.
+func newCastleAPIParams(u User, identity []UserField, properties map[string]any) (Params, map[string]any) {
+	var params Params
+	if isIdentityField(identity, UserFieldID) {
+		params.Username = u.ID
+	} else {
+		properties = addTrait(properties, UserFieldID, u.ID)
+	}
+	if isIdentityField(identity, UserFieldEmail) {
+		params.Email = u.Email
+	} else {
+		properties = addTrait(properties, UserFieldEmail, u.Email)
+	}
+	if isIdentityField(identity, UserFieldPhone) {
+		params.Phone = u.Phone
+	} else {
+		properties = addTrait(properties, UserFieldPhone, u.Phone)
+	}
+	if isIdentityField(identity, UserFieldAddress) {
+		params.Address = u.Address
+	} else {
+		properties = addTrait(properties, UserFieldAddress, u.Address)
+	}
+	// Filter params have no name, so it is only ever sent as a property
+	if !isIdentityField(identity, UserFieldName) {
+		properties = addTrait(properties, UserFieldName, u.Name)
+	}
+	return params, properties
 }
 
 type castleAPIRequest interface {
 	GetEventType() EventType
 	GetUserAgent() string
+	appendJSON(e *encoder, b []byte) []byte
 }
 
 type castleFilterAPIRequest struct {
-	Type         EventType         `json:"type"`
-	Name         string            `json:"name,omitempty"`
-	Status       EventStatus       `json:"status"`
-	RequestToken string            `json:"request_token"`
-	Params       Params            `json:"params"`
-	Context      *Context          `json:"context"`
-	Properties   map[string]string `json:"properties,omitempty"`
-	CreatedAt    time.Time         `json:"created_at"`
+	Type                 EventType             `json:"type"`
+	Name                 string                `json:"name,omitempty"`
+	Status               EventStatus           `json:"status"`
+	RequestToken         string                `json:"request_token"`
+	Params               Params                `json:"params"`
+	MatchingUserID       string                `json:"matching_user_id,omitempty"`
+	Context              *Context              `json:"context"`
+	Properties           map[string]any        `json:"properties,omitempty"`
+	AuthenticationMethod *AuthenticationMethod `json:"authentication_method,omitempty"`
+	Transaction          *Transaction          `json:"transaction,omitempty"`
+	Changeset            map[string]Change     `json:"changeset,omitempty"`
+	Product              *Product              `json:"product,omitempty"`
+	CreatedAt            time.Time             `json:"created_at"`
 }
 
 func (r *castleFilterAPIRequest) GetEventType() EventType {
@@ -105,14 +288,59 @@ func (r *castleFilterAPIRequest) GetUserAgent() string {
 }
 
 type castleRiskAPIRequest struct {
-	Type         EventType         `json:"type"`
-	Name         string            `json:"name,omitempty"`
-	Status       EventStatus       `json:"status"`
-	RequestToken string            `json:"request_token"`
-	User         User              `json:"user"`
-	Context      *Context          `json:"context"`
-	Properties   map[string]string `json:"properties,omitempty"`
-	CreatedAt    time.Time         `json:"created_at"`
+	Type                 EventType             `json:"type"`
+	Name                 string                `json:"name,omitempty"`
+	Status               EventStatus           `json:"status"`
+	RequestToken         string                `json:"request_token"`
+	User                 castleAPIUser         `json:"user"`
+	Context              *Context              `json:"context"`
+	Properties           map[string]any        `json:"properties,omitempty"`
+	AuthenticationMethod *AuthenticationMethod `json:"authentication_method,omitempty"`
+	Transaction          *Transaction          `json:"transaction,omitempty"`
+	Changeset            map[string]Change     `json:"changeset,omitempty"`
+	Product              *Product              `json:"product,omitempty"`
+	CreatedAt            time.Time             `json:"created_at"`
+}
+
+// castleAPIUser is the wire representation of User, with string and typed traits merged.
+type castleAPIUser struct {
+	ID           string         `json:"id"`
+	Email        string         `json:"email,omitempty"`
+	Phone        string         `json:"phone,omitempty"`
+	Name         string         `json:"name,omitempty"`
+	Address      *Address       `json:"address,omitempty"`
+	RegisteredAt string         `json:"registered_at,omitempty"`
+	Traits       map[string]any `json:"traits,omitempty"`
+}
+
+// newCastleAPIUser maps u to the Risk user, fields that are not identity fields are sent as traits instead.
+func newCastleAPIUser(u User, identity []UserField) castleAPIUser {
+	au := castleAPIUser{
+		ID:           u.ID,
+		RegisteredAt: u.RegisteredAt,
+		Traits:       mergeProperties(u.Traits, u.TypedTraits),
+	}
+	if isIdentityField(identity, UserFieldEmail) {
+		au.Email = u.Email
+	} else {
+		au.Traits = addTrait(au.Traits, UserFieldEmail, u.Email)
+	}
+	if isIdentityField(identity, UserFieldPhone) {
+		au.Phone = u.Phone
+	} else {
+		au.Traits = addTrait(au.Traits, UserFieldPhone, u.Phone)
+	}
+	if isIdentityField(identity, UserFieldName) {
+		au.Name = u.Name
+	} else {
+		au.Traits = addTrait(au.Traits, UserFieldName, u.Name)
+	}
+	if isIdentityField(identity, UserFieldAddress) {
+		au.Address = u.Address
+	} else {
+		au.Traits = addTrait(au.Traits, UserFieldAddress, u.Address)
+	}
+	return au
 }
 
 func (r *castleRiskAPIRequest) GetEventType() EventType {
@@ -140,7 +368,7 @@ type castleAPIResponse struct {
 
 func userAgentFromContext(context *Context) string {
 	for k, v := range context.Headers {
-		if strings.ToLower(k) == "user-agent" {
+		if strings.EqualFold(k, "user-agent") {
 			return v
 		}
 	}
@@ -0,0 +1,180 @@
+package castle
+
+import (
+	"errors"
+	"maps"
+	"strings"
+)
+
+// Normalization rewrites emails and phone numbers into a canonical form before they are sent,
+// so Castle links the identities of the same person however they were typed.
+type Normalization struct {
+	// Email trims and lower-cases emails.
+	Email bool
+	// EmailProviders also canonicalises the emails of providers ignoring parts of the address, i.e. dots and
+	// plus tags for Gmail and plus tags for Outlook, iCloud, Fastmail and Proton. It implies Email.
+	EmailProviders bool
+	// Phone formats phone numbers as E.164. Numbers in national format are formatted for DefaultRegion,
+	// they are left as is when it is empty or not one of the supported regions.
+	Phone bool
+	// DefaultRegion is an ISO 3166-1 alpha-2 country code, e.g. "GB".
+	DefaultRegion string
+	// KeepOriginal sends the values that were changed as the original_email and original_phone traits to Risk
+	// and properties to Filter.
+	KeepOriginal bool
+}
+
+// WithNormalization normalises the User email and phone of every request of the client.
+func WithNormalization(n Normalization) Opt {
+	return func(o *options) {
+		o.normalization = &n
+	}
+}
+
+func (n *Normalization) validate(privacy *PrivacyPolicy) error {
+	if !n.KeepOriginal || privacy == nil {
+		return nil
+	}
+	if privacy.Fields[UserFieldEmail] != PrivacyKeep || privacy.Fields[UserFieldPhone] != PrivacyKeep {
+		return errors.New("normalization cannot keep original values hashed or dropped by the privacy policy")
+	}
+	return nil
+}
+
+// apply canonicalises the user email and phone, keeping the originals in Risk traits or Filter properties if asked.
+func (n *Normalization) apply(endpoint Endpoint, req *Request) {
+	var originals Properties
+	if n.Email || n.EmailProviders {
+		if email := canonicalEmail(req.User.Email, n.EmailProviders); email != req.User.Email {
+			originals = originals.Set("original_email", req.User.Email)
+			req.User.Email = email
+		}
+	}
+	if n.Phone {
+		if phone, ok := e164(req.User.Phone, n.DefaultRegion); ok && phone != req.User.Phone {
+			originals = originals.Set("original_phone", req.User.Phone)
+			req.User.Phone = phone
+		}
+	}
+	if !n.KeepOriginal || len(originals) == 0 {
+		return
+	}
+
+	if endpoint == EndpointRisk {
+		req.User.TypedTraits = maps.Clone(req.User.TypedTraits)
+		for k, v := range originals {
+			req.User.TypedTraits = req.User.TypedTraits.Set(k, v)
+		}
+		return
+	}
+	req.TypedProperties = maps.Clone(req.TypedProperties)
+	for k, v := range originals {
+		req.TypedProperties = req.TypedProperties.Set(k, v)
+	}
+}
+
+// canonicalEmail lower-cases the email and, with providers, removes the parts ignored by its provider.
+func canonicalEmail(email string, providers bool) string {
+	if email == "" {
+		return email
+	}
+	email = normalizeEmail(email)
+	if !providers {
+		return email
+	}
+
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || local == "" || strings.Contains(domain, "@") {
+		return email
+	}
+	switch domain {
+	case "gmail.com", "googlemail.com":
+		domain = "gmail.com"
+		local, _, _ = strings.Cut(local, "+")
+		local = strings.ReplaceAll(local, ".", "")
+	case "outlook.com", "hotmail.com", "live.com", "icloud.com", "me.com", "fastmail.com", "proton.me", "protonmail.com":
+		local, _, _ = strings.Cut(local, "+")
+	}
+	if local == "" {
+		return email
+	}
+	return local + "@" + domain
+}
+
+// phoneRegion describes how national numbers of a region are written.
+type phoneRegion struct {
+	callingCode string
+	// trunkPrefix is dropped from national numbers, e.g. the leading 0 of UK numbers.
+	trunkPrefix string
+}
+
+var phoneRegions = map[string]phoneRegion{
+	"AU": {callingCode: "61", trunkPrefix: "0"},
+	"BE": {callingCode: "32", trunkPrefix: "0"},
+	"CA": {callingCode: "1", trunkPrefix: "1"},
+	"DE": {callingCode: "49", trunkPrefix: "0"},
+	"ES": {callingCode: "34"},
+	"FR": {callingCode: "33", trunkPrefix: "0"},
+	"GB": {callingCode: "44", trunkPrefix: "0"},
+	"IE": {callingCode: "353", trunkPrefix: "0"},
+	"IN": {callingCode: "91", trunkPrefix: "0"},
+	// Italian numbers keep their leading 0
+	"IT": {callingCode: "39"},
+	"NL": {callingCode: "31", trunkPrefix: "0"},
+	"NZ": {callingCode: "64", trunkPrefix: "0"},
+	"PL": {callingCode: "48"},
+	"PT": {callingCode: "351"},
+	"SE": {callingCode: "46", trunkPrefix: "0"},
+	"US": {callingCode: "1", trunkPrefix: "1"},
+	"ZA": {callingCode: "27", trunkPrefix: "0"},
+}
+
+const (
+	e164MinDigits = 8
+	e164MaxDigits = 15
+)
+
+// e164 formats the phone number as E.164, reporting whether it could.
+func e164(phone, region string) (string, bool) {
+	phone = strings.TrimSpace(phone)
+	if phone == "" {
+		return "", false
+	}
+	// e.g. +44 (0)20 7946 0000
+	phone = strings.Replace(phone, "(0)", "", 1)
+
+	international := strings.HasPrefix(phone, "+")
+	digits := make([]byte, 0, len(phone))
+	for i := 0; i < len(phone); i++ {
+		switch c := phone[i]; {
+		case c >= '0' && c <= '9':
+			digits = append(digits, c)
+		case c == '+' || c == ' ' || c == '-' || c == '.' || c == '(' || c == ')' || c == '/':
+		default:
+			// letters, extensions and the like are left alone
+			return "", false
+		}
+	}
+	if !international && len(digits) > 2 && digits[0] == '0' && digits[1] == '0' {
+		international = true
+		digits = digits[2:]
+	}
+
+	number := string(digits)
+	if !international {
+		r, ok := phoneRegions[strings.ToUpper(region)]
+		if !ok {
+			return "", false
+		}
+		national := strings.TrimPrefix(number, r.trunkPrefix)
+		// the North American trunk prefix is optional, only strip it from 11 digit numbers
+		if r.callingCode == "1" && len(number) != 11 {
+			national = number
+		}
+		number = r.callingCode + national
+	}
+	if len(number) < e164MinDigits || len(number) > e164MaxDigits {
+		return "", false
+	}
+	return "+" + number, true
+}
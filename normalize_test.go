@@ -0,0 +1,136 @@
+package castle_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/utilitywarehouse/castle-go"
+)
+
+func TestNormalization(t *testing.T) {
+	got := map[string]any{}
+	cstl := newCapturingClient(t, got, castle.WithNormalization(castle.Normalization{
+		EmailProviders: true,
+		Phone:          true,
+		DefaultRegion:  "GB",
+	}))
+
+	tests := map[string]struct {
+		user     castle.User
+		expected map[string]any
+	}{
+		"mixed case email": {
+			user:     castle.User{Email: " Jane.Doe@Example.COM "},
+			expected: map[string]any{"email": "jane.doe@example.com"},
+		},
+		"gmail dots and plus tag": {
+			user:     castle.User{Email: "Jane.Doe+castle@googlemail.com"},
+			expected: map[string]any{"email": "janedoe@gmail.com"},
+		},
+		"outlook plus tag": {
+			user:     castle.User{Email: "jane.doe+castle@outlook.com"},
+			expected: map[string]any{"email": "jane.doe@outlook.com"},
+		},
+		"other provider plus tag": {
+			user:     castle.User{Email: "jane.doe+castle@example.com"},
+			expected: map[string]any{"email": "jane.doe+castle@example.com"},
+		},
+		"national phone": {
+			user:     castle.User{Phone: "07700 900000"},
+			expected: map[string]any{"phone": "+447700900000"},
+		},
+		"international phone": {
+			user:     castle.User{Phone: "+44 (0)20 7946-0000"},
+			expected: map[string]any{"phone": "+442079460000"},
+		},
+		"international prefix": {
+			user:     castle.User{Phone: "00353 87 123 4567"},
+			expected: map[string]any{"phone": "+353871234567"},
+		},
+		"invalid phone": {
+			user:     castle.User{Phone: "0770 ext. 12"},
+			expected: map[string]any{"phone": "0770 ext. 12"},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := configureRequest(configureHTTPRequest())
+			req.User = test.user
+			_, err := cstl.Filter(context.Background(), req)
+			require.NoError(t, err)
+
+			assert.Equal(t, test.expected, got["params"])
+			// originals are not kept by default
+			assert.Equal(t, map[string]any{"prop1": "propValue1"}, got["properties"])
+		})
+	}
+}
+
+func TestNormalization_Phone(t *testing.T) {
+	tests := map[string]struct {
+		region   string
+		phone    string
+		expected string
+	}{
+		"US with trunk prefix": {region: "US", phone: "1 (415) 555-0100", expected: "+14155550100"},
+		"US":                   {region: "US", phone: "415.555.0100", expected: "+14155550100"},
+		"IT keeps leading 0":   {region: "IT", phone: "06 1234 5678", expected: "+390612345678"},
+		"unknown region":       {region: "XX", phone: "07700 900000", expected: "07700 900000"},
+		"no region":            {phone: "+33 6 12 34 56 78", expected: "+33612345678"},
+		"too short":            {region: "GB", phone: "0123", expected: "0123"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := map[string]any{}
+			cstl := newCapturingClient(t, got, castle.WithNormalization(castle.Normalization{Phone: true, DefaultRegion: test.region}))
+
+			req := configureRequest(configureHTTPRequest())
+			req.User = castle.User{ID: "user-id", Phone: test.phone}
+			_, err := cstl.Risk(context.Background(), req)
+			require.NoError(t, err)
+
+			assert.Equal(t, test.expected, got["user"].(map[string]any)["phone"])
+		})
+	}
+}
+
+func TestNormalization_KeepOriginal(t *testing.T) {
+	got := map[string]any{}
+	cstl := newCapturingClient(t, got, castle.WithNormalization(castle.Normalization{
+		Email:         true,
+		Phone:         true,
+		DefaultRegion: "GB",
+		KeepOriginal:  true,
+	}))
+
+	req := configureRequest(configureHTTPRequest())
+	req.User = castle.User{ID: "user-id", Email: "Jane@Example.com", Phone: "+447700900000"}
+
+	_, err := cstl.Risk(context.Background(), req)
+	require.NoError(t, err)
+	user := got["user"].(map[string]any)
+	assert.Equal(t, "jane@example.com", user["email"])
+	// only changed values are kept
+	assert.Equal(t, map[string]any{"original_email": "Jane@Example.com"}, user["traits"])
+
+	_, err = cstl.Filter(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"prop1": "propValue1", "original_email": "Jane@Example.com"}, got["properties"])
+
+	// the caller's request is untouched
+	assert.Equal(t, "Jane@Example.com", req.User.Email)
+	assert.Nil(t, req.User.TypedTraits)
+	assert.Nil(t, req.TypedProperties)
+
+	_, err = castle.New("secret-string",
+		castle.WithNormalization(castle.Normalization{Email: true, KeepOriginal: true}),
+		castle.WithPrivacyPolicy(castle.PrivacyPolicy{
+			Fields:  map[castle.UserField]castle.PrivacyAction{castle.UserFieldEmail: castle.PrivacyHash},
+			HashKey: []byte("key"),
+		}),
+	)
+	assert.EqualError(t, err, "normalization cannot keep original values hashed or dropped by the privacy policy")
+}
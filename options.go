@@ -1,7 +1,24 @@
 package castle
 
+import "time"
+
 type options struct {
 	metricsEnabled bool
+	tenant         string
+	filterEndpoint string
+	riskEndpoint   string
+	secretProvider SecretProvider
+	timeout        time.Duration
+	warmConns      int
+	latencyBudget  float64
+	fallback       RecommendedAction
+	failureAction  RecommendedAction
+	interceptors   []Interceptor
+	privacy        *PrivacyPolicy
+	normalization  *Normalization
+	sampling       SamplingConfig
+	retries        int
+	retryBackoff   time.Duration
 }
 
 type Opt func(*options)
@@ -11,3 +28,89 @@ func WithMetrics(b bool) Opt {
 		o.metricsEnabled = b
 	}
 }
+
+// WithEndpoints overrides the filter and risk endpoints for a single client.
+// Empty values fall back to the package level FilterEndpoint and RiskEndpoint.
+func WithEndpoints(filter, risk string) Opt {
+	return func(o *options) {
+		o.filterEndpoint = filter
+		o.riskEndpoint = risk
+	}
+}
+
+// WithSecretProvider makes the client fetch the API secret from p on every request,
+// instead of using the static secret passed to the constructor.
+func WithSecretProvider(p SecretProvider) Opt {
+	return func(o *options) {
+		o.secretProvider = p
+	}
+}
+
+// WithTimeout bounds every request made by the client New builds, it defaults to DefaultTimeout.
+// It is ignored by NewWithHTTPClient, where the client passed is used as is.
+func WithTimeout(d time.Duration) Opt {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// WithWarmConnections opens up to n connections to the Castle API in the background when the client is created,
+// see Castle.Warm.
+func WithWarmConnections(n int) Opt {
+	return func(o *options) {
+		o.warmConns = n
+	}
+}
+
+// WithLatencyBudget skips calls to Castle when the context deadline is closer than the given percentile
+// of the latency of recent calls, e.g. 0.95, returning the fallback decision instead. See WithFallback.
+func WithLatencyBudget(percentile float64) Opt {
+	return func(o *options) {
+		o.latencyBudget = percentile
+	}
+}
+
+// WithFallback sets the action of the decision returned when a call to Castle is skipped,
+// it defaults to RecommendedActionNone. Failed calls use WithFailureAction instead.
+func WithFallback(action RecommendedAction) Opt {
+	return func(o *options) {
+		o.fallback = action
+	}
+}
+
+// WithFailureAction sets the action returned along with the error when a call to Castle fails after any retries:
+// network errors and timeouts, 429 and 5xx responses and responses that can't be decoded, e.g.
+// RecommendedActionAllow to fail open or RecommendedActionDeny to fail closed. Other errors, e.g. 4xx responses,
+// are bugs rather than outages and return RecommendedActionNone. It defaults to RecommendedActionNone.
+func WithFailureAction(action RecommendedAction) Opt {
+	return func(o *options) {
+		o.failureAction = action
+	}
+}
+
+// WithRetries retries calls failing with a network error, a 429 or a 5xx response up to n times, waiting backoff
+// before the first retry and doubling it for every other one. Retries stop when the context is done.
+func WithRetries(n int, backoff time.Duration) Opt {
+	return func(o *options) {
+		o.retries = n
+		o.retryBackoff = backoff
+	}
+}
+
+// newOptions applies opts over the defaults.
+func newOptions(opts []Opt) *options {
+	os := &options{
+		metricsEnabled: true,
+		timeout:        DefaultTimeout,
+	}
+	for _, opt := range opts {
+		opt(os)
+	}
+	return os
+}
+
+func withTenant(name string) Opt {
+	return func(o *options) {
+		o.tenant = name
+	}
+}
@@ -0,0 +1,161 @@
+package castle
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"maps"
+	"strings"
+	"unicode"
+)
+
+// PrivacyAction is an enum defining what happens to a field before it is sent to Castle.
+type PrivacyAction int
+
+const (
+	PrivacyKeep PrivacyAction = iota
+	// PrivacyHash replaces the normalised value with its hex encoded HMAC-SHA256.
+	PrivacyHash
+	PrivacyDrop
+)
+
+// PrivacyPolicy hashes or drops personal data before requests are encoded. It applies to the User fields,
+// wherever they are sent, i.e. Filter params and properties or the Risk user and its traits,
+// and to the Context headers. Event properties and user traits are sent as is.
+type PrivacyPolicy struct {
+	// Fields sets the action of each User field, fields not listed are kept.
+	Fields map[UserField]PrivacyAction
+	// Headers sets the action of each header, by name; headers not listed are kept.
+	Headers map[string]PrivacyAction
+	// HashKey is the HMAC key, it is required when anything is hashed and should be kept local.
+	HashKey []byte
+}
+
+// WithPrivacyPolicy applies the privacy policy to every request of the client.
+func WithPrivacyPolicy(p PrivacyPolicy) Opt {
+	return func(o *options) {
+		o.privacy = &p
+	}
+}
+
+func (p *PrivacyPolicy) validate() error {
+	if len(p.HashKey) > 0 {
+		return nil
+	}
+	for _, a := range p.Fields {
+		if a == PrivacyHash {
+			return errors.New("privacy policy hashes fields but has no hash key")
+		}
+	}
+	for _, a := range p.Headers {
+		if a == PrivacyHash {
+			return errors.New("privacy policy hashes headers but has no hash key")
+		}
+	}
+	return nil
+}
+
+// apply hashes or drops the user fields and headers listed by the policy, on a clone of the context when headers are listed.
+func (p *PrivacyPolicy) apply(req *Request) {
+	u := &req.User
+	u.ID = p.applyField(UserFieldID, u.ID, strings.TrimSpace)
+	u.Email = p.applyField(UserFieldEmail, u.Email, normalizeEmail)
+	u.Phone = p.applyField(UserFieldPhone, u.Phone, normalizePhone)
+	u.Name = p.applyField(UserFieldName, u.Name, normalizeName)
+	if u.Address != nil {
+		switch p.Fields[UserFieldAddress] {
+		case PrivacyDrop:
+			u.Address = nil
+		case PrivacyHash:
+			u.Address = &Address{
+				Street:   p.hash(normalizeName(u.Address.Street)),
+				City:     p.hash(normalizeName(u.Address.City)),
+				Postcode: p.hash(normalizePostcode(u.Address.Postcode)),
+				// region and country are not personal data on their own
+				Region:  u.Address.Region,
+				Country: u.Address.Country,
+			}
+		}
+	}
+
+	if len(p.Headers) == 0 || req.Context == nil {
+		return
+	}
+	castleCtx := *req.Context
+	castleCtx.Headers = maps.Clone(castleCtx.Headers)
+	for name, v := range castleCtx.Headers {
+		switch p.headerAction(name) {
+		case PrivacyDrop:
+			delete(castleCtx.Headers, name)
+		case PrivacyHash:
+			castleCtx.Headers[name] = p.hash(strings.TrimSpace(v))
+		}
+	}
+	req.Context = &castleCtx
+}
+
+func (p *PrivacyPolicy) applyField(f UserField, v string, normalize func(string) string) string {
+	if v == "" {
+		return v
+	}
+	switch p.Fields[f] {
+	case PrivacyDrop:
+		return ""
+	case PrivacyHash:
+		return p.hash(normalize(v))
+	default:
+		return v
+	}
+}
+
+func (p *PrivacyPolicy) headerAction(name string) PrivacyAction {
+	if a, ok := p.Headers[name]; ok {
+		return a
+	}
+	for h, a := range p.Headers {
+		if strings.EqualFold(h, name) {
+			return a
+		}
+	}
+	return PrivacyKeep
+}
+
+func (p *PrivacyPolicy) hash(v string) string {
+	if v == "" {
+		return v
+	}
+	return hmacHex(p.HashKey, v)
+}
+
+func hmacHex(key []byte, v string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(v)) // nolint: errcheck
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// normalizeEmail trims and lower-cases the email, so the same address always hashes the same.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// normalizePhone keeps the digits of the phone number and its leading plus sign.
+func normalizePhone(phone string) string {
+	phone = strings.TrimSpace(phone)
+	var b strings.Builder
+	for i, r := range phone {
+		if unicode.IsDigit(r) || (i == 0 && r == '+') {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// normalizeName lower-cases the name and collapses its whitespace.
+func normalizeName(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+func normalizePostcode(postcode string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(postcode), ""))
+}
@@ -0,0 +1,145 @@
+package castle_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/utilitywarehouse/castle-go"
+)
+
+func hmacHex(key, v string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(v))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestPrivacyPolicy(t *testing.T) {
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		w.WriteHeader(http.StatusCreated)
+		_, err = w.Write([]byte(`{"policy": {"action": "allow"}}`))
+		assert.NoError(t, err)
+	}))
+	t.Cleanup(ts.Close)
+
+	policy := castle.PrivacyPolicy{
+		Fields: map[castle.UserField]castle.PrivacyAction{
+			castle.UserFieldEmail:   castle.PrivacyHash,
+			castle.UserFieldPhone:   castle.PrivacyHash,
+			castle.UserFieldName:    castle.PrivacyDrop,
+			castle.UserFieldAddress: castle.PrivacyHash,
+		},
+		Headers: map[string]castle.PrivacyAction{
+			"x-user-email":    castle.PrivacyHash,
+			"X-Forwarded-For": castle.PrivacyDrop,
+		},
+		HashKey: []byte("local-key"),
+	}
+	cstl, err := castle.New("secret-string", castle.WithEndpoints(ts.URL, ts.URL), castle.WithPrivacyPolicy(policy))
+	require.NoError(t, err)
+
+	raw := []string{"Jane.Doe@Test.com", "jane.doe@test.com", "+44 7700 900000", "+447700900000", "Jane Doe", "1 Road", "NW1 1AA", "6.6.6.6, 3.3.3.3"}
+	newRequest := func(identity []castle.UserField) *castle.Request {
+		httpReq := configureHTTPRequest()
+		httpReq.Header.Set("X-User-Email", "Jane.Doe@Test.com")
+		req := configureRequest(httpReq)
+		req.User = castle.User{
+			ID:      "user-id",
+			Email:   "Jane.Doe@Test.com",
+			Phone:   "+44 7700 900000",
+			Name:    "Jane Doe",
+			Address: &castle.Address{Street: "1 Road", City: "London", Postcode: "NW1 1AA", Country: "GB"},
+		}
+		req.IdentityFields = identity
+		return req
+	}
+	hashedEmail := hmacHex("local-key", "jane.doe@test.com")
+	hashedPhone := hmacHex("local-key", "+447700900000")
+
+	tests := map[string]struct {
+		send     func(ctx context.Context, req *castle.Request) (castle.RecommendedAction, error)
+		identity []castle.UserField
+		check    func(t *testing.T, got map[string]any)
+	}{
+		"filter": {
+			send: cstl.Filter,
+			check: func(t *testing.T, got map[string]any) {
+				params := got["params"].(map[string]any)
+				assert.Equal(t, hashedEmail, params["email"])
+				assert.Equal(t, hashedPhone, params["phone"])
+				assert.Equal(t, hmacHex("local-key", "NW11AA"), params["address"].(map[string]any)["postal_code"])
+			},
+		},
+		"filter with properties": {
+			send:     cstl.Filter,
+			identity: []castle.UserField{castle.UserFieldID},
+			check: func(t *testing.T, got map[string]any) {
+				properties := got["properties"].(map[string]any)
+				assert.Equal(t, hashedEmail, properties["email"])
+				assert.NotContains(t, properties, "name")
+			},
+		},
+		"risk": {
+			send: cstl.Risk,
+			check: func(t *testing.T, got map[string]any) {
+				user := got["user"].(map[string]any)
+				assert.Equal(t, "user-id", user["id"])
+				assert.Equal(t, hashedEmail, user["email"])
+				assert.NotContains(t, user, "name")
+			},
+		},
+		"risk with traits": {
+			send:     cstl.Risk,
+			identity: []castle.UserField{},
+			check: func(t *testing.T, got map[string]any) {
+				traits := got["user"].(map[string]any)["traits"].(map[string]any)
+				assert.Equal(t, hashedPhone, traits["phone"])
+			},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := newRequest(test.identity)
+			_, err := test.send(context.Background(), req)
+			require.NoError(t, err)
+
+			for _, v := range raw {
+				assert.NotContains(t, string(body), v)
+			}
+
+			got := map[string]any{}
+			require.NoError(t, json.Unmarshal(body, &got))
+			headers := got["context"].(map[string]any)["headers"].(map[string]any)
+			// header values are only trimmed before hashing
+			assert.Equal(t, hmacHex("local-key", "Jane.Doe@Test.com"), headers["X-User-Email"])
+			assert.NotContains(t, headers, "X-Forwarded-For")
+			test.check(t, got)
+
+			// the caller's request is untouched
+			assert.Equal(t, "Jane.Doe@Test.com", req.User.Email)
+			assert.Equal(t, "1 Road", req.User.Address.Street)
+			assert.Equal(t, "Jane.Doe@Test.com", req.Context.Headers["X-User-Email"])
+		})
+	}
+}
+
+func TestPrivacyPolicy_HashKeyRequired(t *testing.T) {
+	_, err := castle.New("secret-string", castle.WithPrivacyPolicy(castle.PrivacyPolicy{
+		Fields: map[castle.UserField]castle.PrivacyAction{castle.UserFieldEmail: castle.PrivacyHash},
+	}))
+	assert.EqualError(t, err, "privacy policy hashes fields but has no hash key")
+}
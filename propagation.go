@@ -0,0 +1,184 @@
+package castle
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PropagationHeader is the suggested header, metadata key or message attribute name for an encoded Castle context.
+const PropagationHeader = "X-Castle-Context"
+
+const (
+	propagationVersion = "v1"
+
+	// DefaultPropagationMaxSize keeps encoded contexts well within common header size limits.
+	DefaultPropagationMaxSize = 4096
+
+	// DefaultPropagationMaxAge bounds how long a leaked context can be replayed.
+	DefaultPropagationMaxAge = 10 * time.Minute
+)
+
+var (
+	ErrContextTooLarge  = errors.New("encoded castle context is too large")
+	ErrInvalidSignature = errors.New("invalid castle context signature")
+	ErrContextExpired   = errors.New("castle context has expired")
+)
+
+// Propagator encodes a Castle context into a single string, so it can travel across service and queue boundaries
+// to the service calling Risk or Filter, and decodes it on the other side.
+//
+// The encoding is "v1.<payload>[.<signature>]", where the payload is base64url encoded JSON
+// and the optional signature an HMAC-SHA256 of the preceding part.
+type Propagator struct {
+	key     []byte
+	maxSize int
+	maxAge  time.Duration
+}
+
+type PropagatorOpt func(*Propagator)
+
+// WithSigningKey signs encoded contexts and only accepts contexts with a valid signature when decoding.
+// All services sharing contexts must use the same key.
+func WithSigningKey(key []byte) PropagatorOpt {
+	return func(p *Propagator) {
+		p.key = key
+	}
+}
+
+// WithMaxSize sets the maximum length of an encoded context, it defaults to DefaultPropagationMaxSize.
+func WithMaxSize(n int) PropagatorOpt {
+	return func(p *Propagator) {
+		p.maxSize = n
+	}
+}
+
+// WithMaxAge rejects decoded contexts captured longer than d ago, it defaults to DefaultPropagationMaxAge.
+// Contexts never expire when d is 0.
+func WithMaxAge(d time.Duration) PropagatorOpt {
+	return func(p *Propagator) {
+		p.maxAge = d
+	}
+}
+
+func NewPropagator(opts ...PropagatorOpt) *Propagator {
+	p := &Propagator{
+		maxSize: DefaultPropagationMaxSize,
+		maxAge:  DefaultPropagationMaxAge,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Signed reports whether the propagator signs contexts and only accepts signed ones, see WithSigningKey.
+func (p *Propagator) Signed() bool {
+	return len(p.key) > 0
+}
+
+type propagatedContext struct {
+	IP           string            `json:"ip,omitempty"`
+	Headers      map[string]string `json:"h,omitempty"`
+	RequestToken string            `json:"t,omitempty"`
+	// CapturedAt is in unix milliseconds
+	CapturedAt int64 `json:"at"`
+}
+
+// Encode encodes the context, recording the current time as its capture time.
+func (p *Propagator) Encode(c *Context) (string, error) {
+	if c == nil {
+		return "", errors.New("castle context cannot be nil")
+	}
+	return p.seal(propagationVersion, "castle context", propagatedContext{
+		IP:           c.IP,
+		Headers:      c.Headers,
+		RequestToken: c.RequestToken,
+		CapturedAt:   time.Now().UnixMilli(),
+	})
+}
+
+// Decode decodes a context encoded by Encode, returning it along with its capture time.
+func (p *Propagator) Decode(s string) (*Context, time.Time, error) {
+	pc := &propagatedContext{}
+	if err := p.open(propagationVersion, "castle context", s, pc); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	capturedAt := time.UnixMilli(pc.CapturedAt)
+	if p.expired(capturedAt) {
+		return nil, time.Time{}, ErrContextExpired
+	}
+
+	headers := pc.Headers
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	return &Context{
+		IP:           pc.IP,
+		Headers:      headers,
+		RequestToken: pc.RequestToken,
+	}, capturedAt, nil
+}
+
+// seal encodes v as "<version>.<payload>[.<signature>]", what names v in errors.
+func (p *Propagator) seal(version, what string, v any) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("unable to encode %s: %w", what, err)
+	}
+
+	s := version + "." + base64.RawURLEncoding.EncodeToString(b)
+	if p.key != nil {
+		s += "." + base64.RawURLEncoding.EncodeToString(p.sign(s))
+	}
+	if len(s) > p.maxSize {
+		return "", ErrContextTooLarge
+	}
+	return s, nil
+}
+
+// open verifies and decodes a string sealed with the same version into v.
+func (p *Propagator) open(version, what, s string, v any) error {
+	if len(s) > p.maxSize {
+		return ErrContextTooLarge
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] != version {
+		return fmt.Errorf("malformed %s", what)
+	}
+	if p.key != nil {
+		if len(parts) != 3 {
+			return ErrInvalidSignature
+		}
+		sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil || !hmac.Equal(sig, p.sign(parts[0]+"."+parts[1])) {
+			return ErrInvalidSignature
+		}
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("malformed %s: %w", what, err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("malformed %s: %w", what, err)
+	}
+	return nil
+}
+
+func (p *Propagator) expired(t time.Time) bool {
+	return p.maxAge > 0 && time.Since(t) > p.maxAge
+}
+
+func (p *Propagator) sign(s string) []byte {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(s)) // nolint: errcheck
+	return mac.Sum(nil)
+}
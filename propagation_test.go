@@ -0,0 +1,111 @@
+package castle_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/utilitywarehouse/castle-go"
+)
+
+func TestPropagator(t *testing.T) {
+	castleCtx := &castle.Context{
+		IP:           "109.14.23.2",
+		Headers:      map[string]string{"User-Agent": "some-agent"},
+		RequestToken: "token",
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		p := castle.NewPropagator()
+
+		before := time.Now().Truncate(time.Millisecond)
+		encoded, err := p.Encode(castleCtx)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(encoded, "v1."))
+
+		got, capturedAt, err := p.Decode(encoded)
+		require.NoError(t, err)
+		assert.Equal(t, castleCtx, got)
+		assert.False(t, capturedAt.Before(before))
+	})
+
+	t.Run("signed round trip", func(t *testing.T) {
+		p := castle.NewPropagator(castle.WithSigningKey([]byte("key")))
+
+		encoded, err := p.Encode(castleCtx)
+		require.NoError(t, err)
+
+		got, _, err := p.Decode(encoded)
+		require.NoError(t, err)
+		assert.Equal(t, castleCtx, got)
+
+		// a propagator without key still reads signed contexts
+		got, _, err = castle.NewPropagator().Decode(encoded)
+		require.NoError(t, err)
+		assert.Equal(t, castleCtx, got)
+	})
+
+	t.Run("invalid signature", func(t *testing.T) {
+		signed, err := castle.NewPropagator(castle.WithSigningKey([]byte("other-key"))).Encode(castleCtx)
+		require.NoError(t, err)
+		unsigned, err := castle.NewPropagator().Encode(castleCtx)
+		require.NoError(t, err)
+
+		p := castle.NewPropagator(castle.WithSigningKey([]byte("key")))
+
+		_, _, err = p.Decode(signed)
+		assert.ErrorIs(t, err, castle.ErrInvalidSignature)
+
+		_, _, err = p.Decode(unsigned)
+		assert.ErrorIs(t, err, castle.ErrInvalidSignature)
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		p := castle.NewPropagator(castle.WithMaxSize(32))
+
+		_, err := p.Encode(castleCtx)
+		assert.ErrorIs(t, err, castle.ErrContextTooLarge)
+
+		_, _, err = p.Decode(strings.Repeat("a", 33))
+		assert.ErrorIs(t, err, castle.ErrContextTooLarge)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		p := castle.NewPropagator(castle.WithMaxAge(time.Millisecond))
+
+		encoded, err := p.Encode(castleCtx)
+		require.NoError(t, err)
+		time.Sleep(5 * time.Millisecond)
+
+		_, _, err = p.Decode(encoded)
+		assert.ErrorIs(t, err, castle.ErrContextExpired)
+	})
+
+	t.Run("expires by default", func(t *testing.T) {
+		// captured at 1ms after the epoch
+		old := "v1.eyJhdCI6MX0"
+
+		_, _, err := castle.NewPropagator().Decode(old)
+		assert.ErrorIs(t, err, castle.ErrContextExpired)
+
+		_, _, err = castle.NewPropagator(castle.WithMaxAge(0)).Decode(old)
+		assert.NoError(t, err)
+	})
+
+	t.Run("signed", func(t *testing.T) {
+		assert.False(t, castle.NewPropagator().Signed())
+		assert.True(t, castle.NewPropagator(castle.WithSigningKey([]byte("key"))).Signed())
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		p := castle.NewPropagator()
+
+		for _, input := range []string{"", "v1", "v2.e30", "v1.!!!", "v1.bm90LWpzb24", "v1.e30.sig.extra"} {
+			_, _, err := p.Decode(input)
+			assert.ErrorContains(t, err, "malformed castle context", input)
+		}
+	})
+}
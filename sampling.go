@@ -0,0 +1,215 @@
+package castle
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SamplingMode is an enum defining whether calls are sent to Castle.
+type SamplingMode int
+
+const (
+	SamplingSend SamplingMode = iota
+	// SamplingSample sends the calls of a share of the users, see Sampling.Rate.
+	SamplingSample
+	// SamplingSkip sends no calls, e.g. as a kill switch during incidents.
+	SamplingSkip
+)
+
+// UnmarshalText parses "send", "sample" or "skip".
+func (m *SamplingMode) UnmarshalText(b []byte) error {
+	switch string(b) {
+	case "send", "":
+		*m = SamplingSend
+	case "sample":
+		*m = SamplingSample
+	case "skip":
+		*m = SamplingSkip
+	default:
+		return fmt.Errorf("unknown sampling mode %q", b)
+	}
+	return nil
+}
+
+// Sampling decides whether the calls of an event type are sent to Castle.
+type Sampling struct {
+	Mode SamplingMode
+	// Rate is the share of users whose calls are sent with SamplingSample, between 0 and 1.
+	Rate float64
+	// Fallback is the action of the decision returned for calls not sent, the client fallback when empty.
+	// See WithFallback.
+	Fallback RecommendedAction
+}
+
+// SamplingConfig returns the sampling of the calls of the event type to the endpoint.
+// It is called for every call, so it can change at any time, but should be cheap.
+type SamplingConfig func(endpoint Endpoint, eventType EventType) Sampling
+
+// WithSampling decides per event type and endpoint whether calls are sent, sampled or skipped.
+// Skipped calls return the fallback decision with Skipped set and are counted with the skipped status in metrics.
+func WithSampling(cfg SamplingConfig) Opt {
+	return func(o *options) {
+		o.sampling = cfg
+	}
+}
+
+// sends reports whether the request is sent. Sampling is deterministic: the calls of a user are either all sent or
+// none are, users are identified by their ID, their email for anonymous Filter calls, or the request token otherwise.
+func (s Sampling) sends(req *Request) bool {
+	switch s.Mode {
+	case SamplingSkip:
+		return false
+	case SamplingSample:
+		if s.Rate >= 1 {
+			return true
+		}
+		key := cmp.Or(req.User.ID, req.User.Email)
+		if key == "" && req.Context != nil {
+			key = req.Context.RequestToken
+		}
+		h := fnv.New64a()
+		h.Write([]byte(key)) // nolint: errcheck
+		return float64(mix64(h.Sum64()))/math.MaxUint64 < s.Rate
+	default:
+		return true
+	}
+}
+
+// mix64 is the murmur3 finaliser, FNV alone spreads similar keys such as sequential IDs poorly.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// SamplingRule is the sampling of the calls matching its endpoint and event type, empty values match any.
+type SamplingRule struct {
+	Endpoint  Endpoint          `json:"endpoint,omitempty"`
+	EventType EventType         `json:"event,omitempty"`
+	Mode      SamplingMode      `json:"mode"`
+	Rate      float64           `json:"rate,omitempty"`
+	Fallback  RecommendedAction `json:"fallback,omitempty"`
+}
+
+// samplingCheckInterval is how often a SamplingFile looks for changes.
+const samplingCheckInterval = time.Second
+
+// SamplingFile reads sampling rules from a JSON file, reloading it when it changes, e.g. a Kubernetes config map:
+//
+//	{"rules": [{"event": "$custom", "mode": "sample", "rate": 0.1}, {"endpoint": "filter", "event": "$login", "mode": "skip", "fallback": "allow"}]}
+//
+// Rules matching both the endpoint and the event type win over those matching the event type only, which win over
+// those matching the endpoint only. Calls matching no rule are sent.
+type SamplingFile struct {
+	path    string
+	onError func(err error)
+
+	rules atomic.Pointer[[]SamplingRule]
+	// checkedAt is in unix nanoseconds
+	checkedAt atomic.Int64
+
+	// mu is held by the reload in progress, modTime and size are only used under it
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+}
+
+// NewSamplingFile reads the rules from path. The file is checked for changes at most once a second afterwards,
+// in the background, a file that can't be read or parsed keeps the previous rules and its error is passed to
+// onError, if not nil.
+func NewSamplingFile(path string, onError func(err error)) (*SamplingFile, error) {
+	f := &SamplingFile{path: path, onError: onError}
+	f.checkedAt.Store(time.Now().UnixNano())
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Config implements SamplingConfig, pass it to WithSampling. It never waits for the file to be read.
+func (f *SamplingFile) Config(endpoint Endpoint, eventType EventType) Sampling {
+	if now := time.Now().UnixNano(); now-f.checkedAt.Load() >= int64(samplingCheckInterval) && f.mu.TryLock() {
+		f.checkedAt.Store(now)
+		go func() {
+			defer f.mu.Unlock()
+			if err := f.reload(); err != nil && f.onError != nil {
+				f.onError(err)
+			}
+		}()
+	}
+
+	rules := *f.rules.Load()
+	var match *SamplingRule
+	best := -1
+	for i := range rules {
+		r := &rules[i]
+		if (r.Endpoint != "" && r.Endpoint != endpoint) || (r.EventType != "" && r.EventType != eventType) {
+			continue
+		}
+		score := 0
+		if r.EventType != "" {
+			score += 2
+		}
+		if r.Endpoint != "" {
+			score++
+		}
+		if score > best {
+			match, best = r, score
+		}
+	}
+	if match == nil {
+		return Sampling{}
+	}
+	return Sampling{Mode: match.Mode, Rate: match.Rate, Fallback: match.Fallback}
+}
+
+// reload reads the file if it changed, it must be called with the lock held or before f is shared.
+func (f *SamplingFile) reload() error {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("unable to stat castle sampling file: %w", err)
+	}
+	if f.rules.Load() != nil && fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return nil
+	}
+
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("unable to read castle sampling file: %w", err)
+	}
+	var config struct {
+		Rules []SamplingRule `json:"rules"`
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return fmt.Errorf("unable to parse castle sampling file: %w", err)
+	}
+	for _, r := range config.Rules {
+		if r.Rate < 0 || r.Rate > 1 {
+			return fmt.Errorf("invalid sampling rate %v for %q", r.Rate, r.EventType)
+		}
+		switch r.Fallback {
+		case RecommendedActionNone, RecommendedActionAllow, RecommendedActionChallenge, RecommendedActionDeny:
+		default:
+			return fmt.Errorf("invalid fallback %q for %q", r.Fallback, r.EventType)
+		}
+	}
+
+	rules := config.Rules
+	if rules == nil {
+		rules = []SamplingRule{}
+	}
+	f.rules.Store(&rules)
+	f.modTime = fi.ModTime()
+	f.size = fi.Size()
+	return nil
+}
@@ -0,0 +1,137 @@
+package castle_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/utilitywarehouse/castle-go"
+)
+
+func TestSampling(t *testing.T) {
+	got := map[string]any{}
+	cstl := newCapturingClient(t, got,
+		castle.WithFallback(castle.RecommendedActionChallenge),
+		castle.WithSampling(func(endpoint castle.Endpoint, eventType castle.EventType) castle.Sampling {
+			switch {
+			case endpoint == castle.EndpointFilter && eventType == castle.EventTypeLogin:
+				return castle.Sampling{Mode: castle.SamplingSkip, Fallback: castle.RecommendedActionAllow}
+			case eventType == castle.EventTypeLogout:
+				return castle.Sampling{Mode: castle.SamplingSkip}
+			case eventType == castle.EventTypeCustom:
+				return castle.Sampling{Mode: castle.SamplingSample, Rate: 0.3}
+			}
+			return castle.Sampling{}
+		}),
+	)
+
+	t.Run("skip", func(t *testing.T) {
+		clear(got)
+		decision, err := cstl.FilterDecision(context.Background(), configureRequest(configureHTTPRequest()))
+		require.NoError(t, err)
+		assert.Equal(t, &castle.Decision{Action: castle.RecommendedActionAllow, Skipped: true}, decision)
+		assert.Empty(t, got)
+
+		req := configureRequest(configureHTTPRequest())
+		req.Event.EventType = castle.EventTypeLogout
+		decision, err = cstl.RiskDecision(context.Background(), req)
+		require.NoError(t, err)
+		assert.Equal(t, &castle.Decision{Action: castle.RecommendedActionChallenge, Skipped: true}, decision)
+		assert.Empty(t, got)
+	})
+
+	t.Run("send", func(t *testing.T) {
+		clear(got)
+		_, err := cstl.Risk(context.Background(), configureRequest(configureHTTPRequest()))
+		require.NoError(t, err)
+		assert.NotEmpty(t, got)
+	})
+
+	t.Run("sample", func(t *testing.T) {
+		sampled := 0
+		for i := range 1000 {
+			req := configureRequest(configureHTTPRequest())
+			req.Event.EventType = castle.EventTypeCustom
+			req.User.ID = fmt.Sprintf("user-%d", i)
+
+			first, err := cstl.RiskDecision(context.Background(), req)
+			require.NoError(t, err)
+			// the same user is always sampled the same way
+			second, err := cstl.RiskDecision(context.Background(), req)
+			require.NoError(t, err)
+			assert.Equal(t, first.Skipped, second.Skipped)
+
+			if !first.Skipped {
+				sampled++
+			}
+		}
+		assert.InDelta(t, 300, sampled, 60)
+	})
+}
+
+func TestSamplingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sampling.json")
+	write := func(content string) {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+
+	write(`{"rules": [
+		{"event": "$custom", "mode": "sample", "rate": 0.1},
+		{"endpoint": "filter", "mode": "skip"},
+		{"endpoint": "filter", "event": "$login", "mode": "skip", "fallback": "allow"}
+	]}`)
+
+	errs := make(chan error, 1)
+	f, err := castle.NewSamplingFile(path, func(err error) { errs <- err })
+	require.NoError(t, err)
+
+	assert.Equal(t, castle.Sampling{Mode: castle.SamplingSample, Rate: 0.1}, f.Config(castle.EndpointRisk, castle.EventTypeCustom))
+	assert.Equal(t, castle.Sampling{Mode: castle.SamplingSample, Rate: 0.1}, f.Config(castle.EndpointFilter, castle.EventTypeCustom))
+	assert.Equal(t, castle.Sampling{Mode: castle.SamplingSkip, Fallback: castle.RecommendedActionAllow}, f.Config(castle.EndpointFilter, castle.EventTypeLogin))
+	assert.Equal(t, castle.Sampling{Mode: castle.SamplingSkip}, f.Config(castle.EndpointFilter, castle.EventTypeRegistration))
+	assert.Equal(t, castle.Sampling{}, f.Config(castle.EndpointRisk, castle.EventTypeLogin))
+
+	// an invalid file keeps the previous rules
+	write(`{"rules": [{"event": "$login", "mode": "later"}]}`)
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	time.Sleep(time.Second)
+	// the file is reloaded in the background, the call doesn't wait for it
+	assert.Equal(t, castle.Sampling{Mode: castle.SamplingSkip, Fallback: castle.RecommendedActionAllow}, f.Config(castle.EndpointFilter, castle.EventTypeLogin))
+	select {
+	case err := <-errs:
+		assert.ErrorContains(t, err, `unknown sampling mode "later"`)
+	case <-time.After(time.Second):
+		t.Fatal("expected the error handler to be called")
+	}
+	assert.Equal(t, castle.Sampling{Mode: castle.SamplingSkip, Fallback: castle.RecommendedActionAllow}, f.Config(castle.EndpointFilter, castle.EventTypeLogin))
+
+	write(`{"rules": [{"event": "$login", "mode": "skip"}]}`)
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute)))
+	time.Sleep(time.Second)
+	assert.Eventually(t, func() bool {
+		return f.Config(castle.EndpointRisk, castle.EventTypeLogin) == castle.Sampling{Mode: castle.SamplingSkip}
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = castle.NewSamplingFile(filepath.Join(t.TempDir(), "missing.json"), nil)
+	assert.Error(t, err)
+}
+
+func BenchmarkSamplingFile_Config(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "sampling.json")
+	require.NoError(b, os.WriteFile(path, []byte(`{"rules": [{"event": "$custom", "mode": "sample", "rate": 0.1}]}`), 0o600))
+	f, err := castle.NewSamplingFile(path, nil)
+	require.NoError(b, err)
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			f.Config(castle.EndpointFilter, castle.EventTypeLogin)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package castle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SecretProvider supplies the Castle API secret. It is consulted on every request,
+// so implementations can pick up a rotated secret without restarting the service.
+//
+// Implementations must never include the secret itself in returned errors.
+type SecretProvider interface {
+	Secret(ctx context.Context) (string, error)
+}
+
+// StaticSecret is a SecretProvider that always returns the same secret.
+type StaticSecret string
+
+// Secret implements SecretProvider.
+func (s StaticSecret) Secret(context.Context) (string, error) {
+	if s == "" {
+		return "", errors.New("castle api secret is empty")
+	}
+	return string(s), nil
+}
+
+// EnvSecret is a SecretProvider that reads the secret from the named environment variable.
+type EnvSecret string
+
+// Secret implements SecretProvider.
+func (e EnvSecret) Secret(context.Context) (string, error) {
+	secret := os.Getenv(string(e))
+	if secret == "" {
+		return "", fmt.Errorf("environment variable %q is not set", string(e))
+	}
+	return secret, nil
+}
+
+// FileSecret is a SecretProvider that reads the secret from a file, e.g. a Kubernetes secret mount.
+// The file is re-read whenever its modification time or size changes.
+type FileSecret struct {
+	path string
+
+	mu      sync.Mutex
+	secret  string
+	modTime time.Time
+	size    int64
+}
+
+// NewFileSecret creates a FileSecret reading from path. The file is read lazily on first use.
+func NewFileSecret(path string) *FileSecret {
+	return &FileSecret{path: path}
+}
+
+// Secret implements SecretProvider.
+func (f *FileSecret) Secret(context.Context) (string, error) {
+	// os.Stat follows symlinks, so this also catches the atomic symlink swap used by Kubernetes.
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return "", fmt.Errorf("unable to stat castle secret file: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.secret != "" && fi.ModTime().Equal(f.modTime) && fi.Size() == f.size {
+		return f.secret, nil
+	}
+
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read castle secret file: %w", err)
+	}
+	secret := strings.TrimSpace(string(b))
+	if secret == "" {
+		return "", fmt.Errorf("castle secret file %q is empty", f.path)
+	}
+
+	f.secret = secret
+	f.modTime = fi.ModTime()
+	f.size = fi.Size()
+	return f.secret, nil
+}
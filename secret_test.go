@@ -0,0 +1,113 @@
+package castle_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/utilitywarehouse/castle-go"
+)
+
+func TestStaticSecret(t *testing.T) {
+	got, err := castle.StaticSecret("foo").Secret(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "foo", got)
+
+	_, err = castle.StaticSecret("").Secret(context.Background())
+	assert.ErrorContains(t, err, "castle api secret is empty")
+}
+
+func TestEnvSecret(t *testing.T) {
+	t.Setenv("CASTLE_TEST_SECRET", "super-secret")
+
+	got, err := castle.EnvSecret("CASTLE_TEST_SECRET").Secret(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "super-secret", got)
+
+	_, err = castle.EnvSecret("CASTLE_TEST_MISSING").Secret(context.Background())
+	assert.ErrorContains(t, err, `environment variable "CASTLE_TEST_MISSING" is not set`)
+}
+
+func TestFileSecret(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "secret")
+
+	p := castle.NewFileSecret(path)
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := p.Secret(ctx)
+		assert.ErrorContains(t, err, "unable to stat castle secret file")
+	})
+
+	t.Run("reads and trims", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(path, []byte("first-secret\n"), 0o600))
+
+		got, err := p.Secret(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "first-secret", got)
+	})
+
+	t.Run("re-reads on change", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(path, []byte("second-secret-value\n"), 0o600))
+		later := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(path, later, later))
+
+		got, err := p.Secret(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "second-secret-value", got)
+	})
+
+	t.Run("empty file", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(path, []byte("\n"), 0o600))
+
+		_, err := p.Secret(ctx)
+		assert.ErrorContains(t, err, "is empty")
+	})
+}
+
+func TestCastle_WithSecretProvider(t *testing.T) {
+	ctx := context.Background()
+	req := configureRequest(configureHTTPRequest())
+
+	t.Run("secret is fetched per request", func(t *testing.T) {
+		t.Setenv("CASTLE_TEST_SECRET", "first")
+
+		var got []string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, password, _ := r.BasicAuth()
+			got = append(got, password)
+			w.WriteHeader(http.StatusCreated)
+			_, err := w.Write([]byte(`{"policy": {"action": "allow"}}`))
+			require.NoError(t, err)
+		}))
+		t.Cleanup(ts.Close)
+
+		cstl, err := castle.New("", castle.WithSecretProvider(castle.EnvSecret("CASTLE_TEST_SECRET")), castle.WithEndpoints(ts.URL, ts.URL))
+		require.NoError(t, err)
+
+		_, err = cstl.Filter(ctx, req)
+		require.NoError(t, err)
+
+		t.Setenv("CASTLE_TEST_SECRET", "second")
+		_, err = cstl.Filter(ctx, req)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"first", "second"}, got)
+	})
+
+	t.Run("provider error", func(t *testing.T) {
+		cstl, err := castle.New("", castle.WithSecretProvider(castle.EnvSecret("CASTLE_TEST_MISSING")))
+		require.NoError(t, err)
+
+		res, err := cstl.Risk(ctx, req)
+		assert.ErrorContains(t, err, "unable to get castle api secret")
+		assert.Equal(t, castle.RecommendedActionNone, res)
+	})
+}
@@ -0,0 +1,140 @@
+package castle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrUnknownTenant is returned when a request cannot be routed to a configured tenant.
+var ErrUnknownTenant = errors.New("unknown castle tenant")
+
+var tenantCtxKey = contextKey("castle_tenant")
+
+// TenantToCtx adds the tenant name to the context.Context.
+func TenantToCtx(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, tenantCtxKey, name)
+}
+
+// TenantFromCtx returns the tenant name from the context.Context, or an empty string if it is not set.
+func TenantFromCtx(ctx context.Context) string {
+	name, _ := ctx.Value(tenantCtxKey).(string)
+	return name
+}
+
+// Tenant describes a single Castle environment, e.g. one per brand.
+type Tenant struct {
+	// Name identifies the tenant when routing and is used as the tenant metrics label.
+	Name string
+	// Secret and SecretProvider take precedence over a WithSecretProvider option shared by all tenants.
+	Secret string
+	// SecretProvider takes precedence over Secret when set.
+	SecretProvider SecretProvider
+	// FilterEndpoint and RiskEndpoint are optional, the package defaults are used when empty.
+	FilterEndpoint string
+	RiskEndpoint   string
+}
+
+// TenantResolver picks the tenant name for a call.
+type TenantResolver func(ctx context.Context) string
+
+// MultiTenant routes calls to one of several Castle environments.
+// All tenants share the same http client and metrics.
+type MultiTenant struct {
+	tenants  map[string]*Castle
+	resolver TenantResolver
+}
+
+// NewMultiTenant creates a multi-tenant client, the tenants share a http client built like New does.
+// If resolver is nil, the tenant is taken from the context, see TenantToCtx.
+func NewMultiTenant(tenants []Tenant, resolver TenantResolver, opts ...Opt) (*MultiTenant, error) {
+	return NewMultiTenantWithHTTPClient(tenants, resolver, NewHTTPClient(newOptions(opts).timeout), opts...)
+}
+
+// NewMultiTenantWithHTTPClient same as NewMultiTenant but allows passing of http.Client with custom config
+func NewMultiTenantWithHTTPClient(tenants []Tenant, resolver TenantResolver, client *http.Client, opts ...Opt) (*MultiTenant, error) {
+	if len(tenants) == 0 {
+		return nil, errors.New("at least one tenant is required")
+	}
+	if resolver == nil {
+		resolver = TenantFromCtx
+	}
+
+	m := &MultiTenant{
+		tenants:  make(map[string]*Castle, len(tenants)),
+		resolver: resolver,
+	}
+	for _, t := range tenants {
+		if t.Name == "" {
+			return nil, errors.New("tenant name cannot be empty")
+		}
+		if _, ok := m.tenants[t.Name]; ok {
+			return nil, fmt.Errorf("duplicate tenant %q", t.Name)
+		}
+
+		tenantOpts := make([]Opt, 0, len(opts)+3)
+		tenantOpts = append(tenantOpts, opts...)
+		tenantOpts = append(tenantOpts, withTenant(t.Name), WithEndpoints(t.FilterEndpoint, t.RiskEndpoint))
+		switch {
+		case t.SecretProvider != nil:
+			tenantOpts = append(tenantOpts, WithSecretProvider(t.SecretProvider))
+		case t.Secret != "":
+			tenantOpts = append(tenantOpts, WithSecretProvider(StaticSecret(t.Secret)))
+		case newOptions(opts).secretProvider == nil:
+			return nil, fmt.Errorf("tenant %q: a secret or secret provider is required", t.Name)
+		}
+
+		c, err := NewWithHTTPClient(t.Secret, client, tenantOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %q: %w", t.Name, err)
+		}
+		m.tenants[t.Name] = c
+	}
+	return m, nil
+}
+
+// Tenant returns the client for the named tenant.
+func (m *MultiTenant) Tenant(name string) (*Castle, error) {
+	c, ok := m.tenants[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownTenant, name)
+	}
+	return c, nil
+}
+
+// Filter sends a filter request to castle.io using the tenant resolved from ctx.
+func (m *MultiTenant) Filter(ctx context.Context, req *Request) (RecommendedAction, error) {
+	c, err := m.Tenant(m.resolver(ctx))
+	if err != nil {
+		return RecommendedActionNone, err
+	}
+	return c.Filter(ctx, req)
+}
+
+// Risk sends a risk request to castle.io using the tenant resolved from ctx.
+func (m *MultiTenant) Risk(ctx context.Context, req *Request) (RecommendedAction, error) {
+	c, err := m.Tenant(m.resolver(ctx))
+	if err != nil {
+		return RecommendedActionNone, err
+	}
+	return c.Risk(ctx, req)
+}
+
+// FilterDecision is the same as Filter but returns the full decision.
+func (m *MultiTenant) FilterDecision(ctx context.Context, req *Request) (*Decision, error) {
+	c, err := m.Tenant(m.resolver(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return c.FilterDecision(ctx, req)
+}
+
+// RiskDecision is the same as Risk but returns the full decision.
+func (m *MultiTenant) RiskDecision(ctx context.Context, req *Request) (*Decision, error) {
+	c, err := m.Tenant(m.resolver(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return c.RiskDecision(ctx, req)
+}
@@ -0,0 +1,113 @@
+package castle_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/utilitywarehouse/castle-go"
+)
+
+func TestNewMultiTenant(t *testing.T) {
+	tests := map[string]struct {
+		input       []castle.Tenant
+		expectedErr string
+	}{
+		"no tenants": {
+			input:       nil,
+			expectedErr: "at least one tenant is required",
+		},
+		"empty name": {
+			input:       []castle.Tenant{{Secret: "secret"}},
+			expectedErr: "tenant name cannot be empty",
+		},
+		"duplicate name": {
+			input:       []castle.Tenant{{Name: "foo", Secret: "secret"}, {Name: "foo", Secret: "secret"}},
+			expectedErr: `duplicate tenant "foo"`,
+		},
+		"no secret": {
+			input:       []castle.Tenant{{Name: "foo", Secret: "secret"}, {Name: "bar"}},
+			expectedErr: `tenant "bar": a secret or secret provider is required`,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := castle.NewMultiTenant(test.input, nil)
+			assert.ErrorContains(t, err, test.expectedErr)
+		})
+	}
+}
+
+func TestMultiTenant_Filter(t *testing.T) {
+	req := configureRequest(configureHTTPRequest())
+
+	newServer := func(t *testing.T, secret, action string) *httptest.Server {
+		t.Helper()
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, password, _ := r.BasicAuth()
+			assert.Equal(t, secret, password)
+
+			w.Header().Set("content-type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			_, err := w.Write([]byte(`{"policy": {"action": "` + action + `"}}`))
+			require.NoError(t, err)
+		}))
+		t.Cleanup(ts.Close)
+		return ts
+	}
+
+	foo := newServer(t, "foo-secret", "allow")
+	bar := newServer(t, "bar-secret", "deny")
+
+	mt, err := castle.NewMultiTenant([]castle.Tenant{
+		{Name: "foo", Secret: "foo-secret", FilterEndpoint: foo.URL},
+		{Name: "bar", Secret: "bar-secret", FilterEndpoint: bar.URL},
+	}, nil)
+	require.NoError(t, err)
+
+	t.Run("tenant from context", func(t *testing.T) {
+		res, err := mt.Filter(castle.TenantToCtx(context.Background(), "foo"), req)
+		require.NoError(t, err)
+		assert.Equal(t, castle.RecommendedActionAllow, res)
+
+		res, err = mt.Filter(castle.TenantToCtx(context.Background(), "bar"), req)
+		require.NoError(t, err)
+		assert.Equal(t, castle.RecommendedActionDeny, res)
+	})
+
+	t.Run("unknown tenant", func(t *testing.T) {
+		res, err := mt.Filter(context.Background(), req)
+		assert.ErrorIs(t, err, castle.ErrUnknownTenant)
+		assert.Equal(t, castle.RecommendedActionNone, res)
+	})
+
+	t.Run("custom resolver", func(t *testing.T) {
+		mt, err := castle.NewMultiTenant([]castle.Tenant{
+			{Name: "bar", Secret: "bar-secret", FilterEndpoint: bar.URL},
+		}, func(context.Context) string { return "bar" })
+		require.NoError(t, err)
+
+		res, err := mt.Filter(context.Background(), req)
+		require.NoError(t, err)
+		assert.Equal(t, castle.RecommendedActionDeny, res)
+	})
+	t.Run("tenant secret wins over shared secret provider", func(t *testing.T) {
+		mt, err := castle.NewMultiTenant([]castle.Tenant{
+			{Name: "foo", Secret: "foo-secret", FilterEndpoint: foo.URL},
+			{Name: "bar", Secret: "bar-secret", FilterEndpoint: bar.URL},
+		}, nil, castle.WithSecretProvider(castle.StaticSecret("shared-secret")))
+		require.NoError(t, err)
+
+		res, err := mt.Filter(castle.TenantToCtx(context.Background(), "foo"), req)
+		require.NoError(t, err)
+		assert.Equal(t, castle.RecommendedActionAllow, res)
+
+		res, err = mt.Filter(castle.TenantToCtx(context.Background(), "bar"), req)
+		require.NoError(t, err)
+		assert.Equal(t, castle.RecommendedActionDeny, res)
+	})
+}
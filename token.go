@@ -0,0 +1,131 @@
+package castle
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// TokenExtractor returns the request token found in r, or an empty string.
+type TokenExtractor func(r *http.Request) string
+
+// DefaultTokenExtractor is used by FromHTTPRequest and Middleware unless WithTokenExtractor is passed.
+// It looks at the request token headers first and the form values next.
+var DefaultTokenExtractor = ChainTokenExtractors(
+	TokenFromHeader(validTokenHeaderNames...),
+	TokenFromForm(validTokenFormNames...),
+)
+
+// ChainTokenExtractors returns the first token found by the extractors, in order.
+func ChainTokenExtractors(extractors ...TokenExtractor) TokenExtractor {
+	return func(r *http.Request) string {
+		for _, extract := range extractors {
+			if t := extract(r); t != "" {
+				return t
+			}
+		}
+		return ""
+	}
+}
+
+// TokenFromHeader extracts the token from the first of the named headers that is set.
+func TokenFromHeader(names ...string) TokenExtractor {
+	return func(r *http.Request) string {
+		for _, name := range names {
+			if t := r.Header.Get(name); t != "" {
+				return t
+			}
+		}
+		return ""
+	}
+}
+
+// TokenFromForm extracts the token from the first of the named form values that is set,
+// including both the url-encoded body and the query string.
+func TokenFromForm(names ...string) TokenExtractor {
+	return func(r *http.Request) string {
+		// ParseForm is idempotent, so it's safe to call from anywhere
+		if err := r.ParseForm(); err != nil {
+			return ""
+		}
+
+		for _, name := range names {
+			if t := r.Form.Get(name); t != "" {
+				return t
+			}
+		}
+		return ""
+	}
+}
+
+// TokenFromQuery extracts the token from the first of the named query parameters that is set.
+func TokenFromQuery(names ...string) TokenExtractor {
+	return func(r *http.Request) string {
+		if r.URL == nil {
+			return ""
+		}
+		q := r.URL.Query()
+		for _, name := range names {
+			if t := q.Get(name); t != "" {
+				return t
+			}
+		}
+		return ""
+	}
+}
+
+// TokenFromCookie extracts the token from the named cookie.
+func TokenFromCookie(name string) TokenExtractor {
+	return func(r *http.Request) string {
+		c, err := r.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return c.Value
+	}
+}
+
+// TokenFromJSONBody extracts the token from a top level string field of a JSON body, e.g. "castleRequestToken".
+//
+// At most maxBytes of the body are buffered, larger bodies are not inspected. In both cases the body is
+// restored, so handlers further down the chain can still read all of it.
+func TokenFromJSONBody(field string, maxBytes int64) TokenExtractor {
+	return func(r *http.Request) string {
+		if r.Body == nil || r.Body == http.NoBody || !isJSON(r.Header.Get("Content-Type")) {
+			return ""
+		}
+
+		buf, err := io.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+		r.Body = &restoredBody{Reader: io.MultiReader(bytes.NewReader(buf), r.Body), Closer: r.Body}
+		if err != nil || int64(len(buf)) > maxBytes {
+			return ""
+		}
+
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(buf, &fields); err != nil {
+			return ""
+		}
+		var t string
+		if err := json.Unmarshal(fields[field], &t); err != nil {
+			return ""
+		}
+		return t
+	}
+}
+
+// restoredBody replays the buffered part of a body before the unread remainder.
+type restoredBody struct {
+	io.Reader
+	io.Closer
+}
+
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
@@ -0,0 +1,139 @@
+package castle_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/utilitywarehouse/castle-go"
+)
+
+func TestTokenExtractors(t *testing.T) {
+	tests := map[string]struct {
+		extractor castle.TokenExtractor
+		request   func() *http.Request
+		expected  string
+	}{
+		"header": {
+			extractor: castle.TokenFromHeader("X-Foo", "X-Bar"),
+			request: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/", nil)
+				req.Header.Set("X-Bar", "bar")
+				return req
+			},
+			expected: "bar",
+		},
+		"form": {
+			extractor: castle.TokenFromForm("castle_request_token"),
+			request: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("castle_request_token=form"))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				return req
+			},
+			expected: "form",
+		},
+		"query": {
+			extractor: castle.TokenFromQuery("token"),
+			request: func() *http.Request {
+				return httptest.NewRequest(http.MethodPost, "/?token=query", nil)
+			},
+			expected: "query",
+		},
+		"cookie": {
+			extractor: castle.TokenFromCookie("castle_token"),
+			request: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/", nil)
+				req.AddCookie(&http.Cookie{Name: "castle_token", Value: "cookie"})
+				return req
+			},
+			expected: "cookie",
+		},
+		"json body": {
+			extractor: castle.TokenFromJSONBody("castleRequestToken", 1024),
+			request: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"email": "user@test.com", "castleRequestToken": "json"}`))
+				req.Header.Set("Content-Type", "application/json; charset=utf-8")
+				return req
+			},
+			expected: "json",
+		},
+		"json body of other content type": {
+			extractor: castle.TokenFromJSONBody("castleRequestToken", 1024),
+			request: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"castleRequestToken": "json"}`))
+				req.Header.Set("Content-Type", "text/plain")
+				return req
+			},
+			expected: "",
+		},
+		"json body over the limit": {
+			extractor: castle.TokenFromJSONBody("castleRequestToken", 10),
+			request: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"castleRequestToken": "json"}`))
+				req.Header.Set("Content-Type", "application/json")
+				return req
+			},
+			expected: "",
+		},
+		"chain": {
+			extractor: castle.ChainTokenExtractors(
+				castle.TokenFromHeader("X-Castle-Request-Token"),
+				castle.TokenFromCookie("castle_token"),
+				castle.TokenFromQuery("token"),
+			),
+			request: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/?token=query", nil)
+				req.AddCookie(&http.Cookie{Name: "castle_token", Value: "cookie"})
+				return req
+			},
+			expected: "cookie",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, test.extractor(test.request()))
+		})
+	}
+}
+
+func TestTokenFromJSONBody_RestoresBody(t *testing.T) {
+	for name, limit := range map[string]int64{"within limit": 1024, "over limit": 10} {
+		t.Run(name, func(t *testing.T) {
+			body := `{"castleRequestToken": "json", "password": "secret"}`
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+
+			castle.TokenFromJSONBody("castleRequestToken", limit)(req)
+
+			got, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			assert.Equal(t, body, string(got))
+			require.NoError(t, req.Body.Close())
+		})
+	}
+}
+
+func TestMiddleware_WithTokenExtractor(t *testing.T) {
+	var got *castle.Context
+	handler := castle.Middleware(castle.WithTokenExtractor(castle.TokenFromJSONBody("castleRequestToken", 1024)))(
+		http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			got = castle.FromCtx(r.Context())
+
+			b, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			assert.Equal(t, `{"castleRequestToken": "json"}`, string(b))
+		}),
+	)
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"castleRequestToken": "json"}`))
+	req.Header.Set("Content-Type", "application/json")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	require.NotNil(t, got)
+	assert.Equal(t, "json", got.RequestToken)
+}
@@ -0,0 +1,95 @@
+package castle
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout bounds every request made by the client New builds, unless WithTimeout is passed.
+const DefaultTimeout = 5 * time.Second
+
+const (
+	connectTimeout      = 2 * time.Second
+	tlsHandshakeTimeout = 2 * time.Second
+	// all requests go to a single host, so the idle pool is sized for it alone
+	maxIdleConns    = 64
+	idleConnTimeout = 90 * time.Second
+)
+
+// NewHTTPClient returns the client New uses: its own connection pool to the Castle API, separate from
+// http.DefaultClient, with connect and TLS handshake timeouts, HTTP/2 and timeout bounding whole requests.
+// It is a starting point for clients passed to NewWithHTTPClient.
+func NewHTTPClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			ForceAttemptHTTP2:     true,
+			TLSHandshakeTimeout:   tlsHandshakeTimeout,
+			ResponseHeaderTimeout: timeout,
+			ExpectContinueTimeout: time.Second,
+			MaxIdleConns:          maxIdleConns,
+			MaxIdleConnsPerHost:   maxIdleConns,
+			IdleConnTimeout:       idleConnTimeout,
+		},
+	}
+}
+
+// Warm opens up to conns connections to the hosts of the filter and risk endpoints, so the first
+// requests don't pay for the connect and TLS handshake. With HTTP/2 a single connection is usually kept.
+func (c *Castle) Warm(ctx context.Context, conns int) error {
+	origins := make(map[string]struct{}, 2)
+	for _, endpoint := range []string{c.filterURL(), c.riskURL()} {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return err
+		}
+		origins[u.Scheme+"://"+u.Host] = struct{}{}
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for origin := range origins {
+		for range conns {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := c.warm(ctx, origin); err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// warm sends a HEAD request to origin, the response itself doesn't matter.
+func (c *Castle) warm(ctx context.Context, origin string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, origin, nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, res.Body) // nolint: errcheck
+	return res.Body.Close()
+}
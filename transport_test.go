@@ -0,0 +1,76 @@
+package castle_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/utilitywarehouse/castle-go"
+)
+
+func TestNewHTTPClient(t *testing.T) {
+	client := castle.NewHTTPClient(time.Second)
+	assert.Equal(t, time.Second, client.Timeout)
+	assert.NotSame(t, http.DefaultTransport, client.Transport)
+
+	transport, ok := client.Transport.(*http.Transport)
+	require.True(t, ok)
+	assert.True(t, transport.ForceAttemptHTTP2)
+	assert.NotZero(t, transport.TLSHandshakeTimeout)
+	assert.Equal(t, transport.MaxIdleConns, transport.MaxIdleConnsPerHost)
+}
+
+func TestNew_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		<-release
+	}))
+	t.Cleanup(ts.Close)
+	t.Cleanup(func() { close(release) })
+
+	cstl, err := castle.New("secret-string", castle.WithEndpoints(ts.URL, ts.URL), castle.WithTimeout(50*time.Millisecond))
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = cstl.Filter(context.Background(), configureRequest(configureHTTPRequest()))
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestCastle_Warm(t *testing.T) {
+	var requests, conns atomic.Int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			return
+		}
+		requests.Add(1)
+		// hold the connection until every request has started, so none is reused
+		time.Sleep(50 * time.Millisecond)
+	}))
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	ts.Start()
+	t.Cleanup(ts.Close)
+
+	cstl, err := castle.New("secret-string", castle.WithEndpoints(ts.URL+"/v1/filter", ts.URL+"/v1/risk"))
+	require.NoError(t, err)
+
+	require.NoError(t, cstl.Warm(context.Background(), 3))
+	assert.Equal(t, int32(3), requests.Load())
+	assert.Equal(t, int32(3), conns.Load())
+
+	// the warmed connections are reused
+	_, err = cstl.Filter(context.Background(), configureRequest(configureHTTPRequest()))
+	require.Error(t, err) // the test server doesn't answer 201
+	assert.Equal(t, int32(3), conns.Load())
+}